@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vbatts/go-httplog"
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/hash"
+	"github.com/vbatts/imgsrv/types"
+)
+
+const (
+	apiPrefix       = "/api/v1/"
+	apiMaxPageLimit = 100 // the most files a listing returns at once
+)
+
+// apiFile is a file, as the API describes it
+type apiFile struct {
+	Filename    string     `json:"filename"`
+	Md5         string     `json:"md5"`
+	Size        uint64     `json:"size"`
+	ContentType string     `json:"content_type"`
+	UploadDate  time.Time  `json:"upload_date"`
+	TimeStamp   time.Time  `json:"timestamp"`
+	Modified    *time.Time `json:"modified,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Keywords    []string   `json:"keywords"`
+	Uploader    string     `json:"uploader"`
+	Renamed     []string   `json:"renamed,omitempty"`
+	URL         string     `json:"url"`
+	ViewURL     string     `json:"view_url"`
+	APIURL      string     `json:"api_url"`
+}
+
+func newAPIFile(f types.File) apiFile {
+	name := url.PathEscape(f.Filename)
+	keywords := f.Metadata.Keywords
+	if keywords == nil {
+		keywords = []string{}
+	}
+	return apiFile{
+		Filename:    f.Filename,
+		Md5:         f.Md5,
+		Size:        f.Length,
+		ContentType: f.ContentType(),
+		UploadDate:  f.UploadDate,
+		TimeStamp:   f.Metadata.TimeStamp,
+		Modified:    optionalTime(f.Metadata.Modified),
+		Expires:     optionalTime(f.Metadata.Expires),
+		Keywords:    keywords,
+		Uploader:    f.Metadata.Ip,
+		Renamed:     f.Metadata.Renamed,
+		URL:         "/f/" + name,
+		ViewURL:     "/v/" + name,
+		APIURL:      apiPrefix + "files/" + name,
+	}
+}
+
+// optionalTime is nil for the zero time, so that it is left out
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// apiError is the body of every error response from the API
+type apiError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+/*
+GET    /api/v1/files[?keyword=|md5=|ext=|name=][&limit=&offset=&before=]
+POST   /api/v1/files
+GET    /api/v1/files/:name
+PATCH  /api/v1/files/:name
+DELETE /api/v1/files/:name
+GET    /api/v1/keywords
+GET    /api/v1/extensions
+
+The JSON API, for tools rather than browsers. Errors are answered with
+their status code, and a body of {"error": {"status": ..., "message": ...}}.
+*/
+func routeAPI(w http.ResponseWriter, r *http.Request) {
+	chunks := strings.SplitN(strings.TrimPrefix(r.URL.Path, apiPrefix), "/", 2)
+	switch {
+	case chunks[0] == "files" && (len(chunks) == 1 || len(chunks[1]) == 0):
+		switch r.Method {
+		case "GET", "HEAD":
+			apiListFiles(w, r)
+		case "POST":
+			apiUpload(w, r)
+		default:
+			apiFail(w, r, 405, "method not allowed")
+		}
+	case chunks[0] == "files":
+		filename := strings.ToLower(chunks[1])
+		switch r.Method {
+		case "GET", "HEAD":
+			apiGetFile(w, r, filename)
+		case "PATCH":
+			apiUpdateFile(w, r, filename)
+		case "DELETE":
+			apiDeleteFile(w, r, filename)
+		default:
+			apiFail(w, r, 405, "method not allowed")
+		}
+	case (chunks[0] == "keywords" || chunks[0] == "extensions") && len(chunks) == 1:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			apiFail(w, r, 405, "method not allowed")
+			return
+		}
+		apiCounts(w, r, chunks[0])
+	default:
+		apiFail(w, r, 404, "no such resource")
+	}
+}
+
+// apiListFiles answers with a page of the files, most recent first, narrowed
+// down to one keyword, md5, extension or part of the name, if asked
+func apiListFiles(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var (
+		fetch func(context.Context, dbutil.Page) ([]types.File, error)
+		by    int
+	)
+	if v := q.Get("keyword"); len(v) > 0 {
+		fetch = func(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+			return du.FindFilesByKeyword(ctx, v, page)
+		}
+		by++
+	}
+	if v := q.Get("md5"); len(v) > 0 {
+		fetch = func(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+			return du.FindFilesByMd5(ctx, strings.ToLower(v), page)
+		}
+		by++
+	}
+	if v := q.Get("ext"); len(v) > 0 {
+		pat := "\\." + regexp.QuoteMeta(strings.TrimPrefix(strings.ToLower(v), ".")) + "$"
+		fetch = func(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+			return du.FindFilesByPatt(ctx, pat, page)
+		}
+		by++
+	}
+	if v := q.Get("name"); len(v) > 0 {
+		pat := regexp.QuoteMeta(strings.ToLower(v))
+		fetch = func(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+			return du.FindFilesByPatt(ctx, pat, page)
+		}
+		by++
+	}
+	if by > 1 {
+		apiFail(w, r, 400, "only one of keyword, md5, ext and name can be searched by")
+		return
+	} else if by == 0 {
+		fetch = du.GetFiles
+	}
+
+	page := dbutil.Page{Limit: defaultPageLimit}
+	var err error
+	if v := q.Get("limit"); len(v) > 0 {
+		if page.Limit, err = strconv.Atoi(v); err != nil || page.Limit < 1 || page.Limit > apiMaxPageLimit {
+			apiFail(w, r, 400, fmt.Sprintf("limit must be from 1 to %d", apiMaxPageLimit))
+			return
+		}
+	}
+	if v := q.Get("offset"); len(v) > 0 {
+		if page.Offset, err = strconv.Atoi(v); err != nil || page.Offset < 0 {
+			apiFail(w, r, 400, "offset must be a positive number")
+			return
+		}
+	}
+	if v := q.Get("before"); len(v) > 0 {
+		if page.Before, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			apiFail(w, r, 400, "before must be an RFC 3339 time")
+			return
+		}
+	}
+
+	// one more than is returned, to know whether there is a next page
+	limit := page.Limit
+	page.Limit++
+	files, err := fetch(r.Context(), page)
+	if err != nil {
+		apiServerErr(w, r, err)
+		return
+	}
+	res := struct {
+		Files []apiFile `json:"files"`
+		Next  string    `json:"next,omitempty"`
+	}{Files: []apiFile{}}
+	if len(files) > limit {
+		files = files[:limit]
+		u := *r.URL
+		q.Set("offset", strconv.Itoa(page.Offset+limit))
+		u.RawQuery = q.Encode()
+		res.Next = u.RequestURI()
+	}
+	for _, f := range files {
+		res.Files = append(res.Files, newAPIFile(f))
+	}
+	apiRespond(w, r, 200, res)
+}
+
+// apiGetFile answers with the file stored as filename
+func apiGetFile(w http.ResponseWriter, r *http.Request, filename string) {
+	file, ok := apiLookup(w, r, filename)
+	if !ok {
+		return
+	}
+	apiRespond(w, r, 200, newAPIFile(file))
+}
+
+/*
+apiUpload stores the "file" of a multipart form, or the request body, named
+by the filename parameter, and answers with it. The keywords (comma
+separated), onconflict and expires parameters are those of the upload forms.
+*/
+func apiUpload(w http.ResponseWriter, r *http.Request) {
+	info := types.Info{
+		Ip:        r.RemoteAddr,
+		Random:    hash.Rand64(),
+		TimeStamp: time.Now(),
+	}
+
+	err := r.ParseMultipartForm(maxBytes)
+	if err != nil && err != http.ErrNotMultipart {
+		apiFail(w, r, 400, err.Error())
+		return
+	}
+	filename := r.FormValue("filename")
+	var src io.Reader = r.Body
+	if r.MultipartForm != nil {
+		mf, hdr, err := r.FormFile("file")
+		if err != nil {
+			apiFail(w, r, 400, "the form has no file")
+			return
+		}
+		defer mf.Close()
+		src = mf
+		if len(filename) == 0 {
+			filename = hdr.Filename
+		}
+	}
+	filename = filepath.Base(filename)
+	if len(filename) == 0 || filename == "." || filename == "/" {
+		apiFail(w, r, 400, "a filename is needed")
+		return
+	}
+	info.Keywords = formKeywords(r.Form)
+	if err := formExpires(r.FormValue("expires"), &info); err != nil {
+		apiFail(w, r, 400, err.Error())
+		return
+	}
+
+	filename, _, err = storeUpload(r.Context(), filename, &info, src, onConflict(r.FormValue("onconflict"), "fail"))
+	if err == dbutil.ErrExists {
+		apiFail(w, r, 409, fmt.Sprintf("%s already exists", filename))
+		return
+	} else if err != nil {
+		apiServerErr(w, r, err)
+		return
+	}
+	file, err := du.GetFileByFilename(r.Context(), filename)
+	if err != nil {
+		apiServerErr(w, r, err)
+		return
+	}
+	res := newAPIFile(file)
+	w.Header().Set("Location", res.APIURL)
+	apiRespond(w, r, 201, res)
+}
+
+/*
+apiUpdateFile changes the file stored as filename, as the JSON body says:
+
+	{"keywords": ["a", "b"], "add": ["c"], "remove": ["a"], "filename": "new.png"}
+
+each of which is optional. keywords replaces the file's keywords, before add
+and remove change them, and filename renames it.
+*/
+func apiUpdateFile(w http.ResponseWriter, r *http.Request, filename string) {
+	var req struct {
+		Keywords *[]string `json:"keywords"`
+		Add      []string  `json:"add"`
+		Remove   []string  `json:"remove"`
+		Filename string    `json:"filename"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBytes)).Decode(&req); err != nil {
+		apiFail(w, r, 400, fmt.Sprintf("the body is not the JSON expected: %s", err))
+		return
+	}
+	to := strings.ToLower(req.Filename)
+	if strings.Contains(to, "/") {
+		apiFail(w, r, 400, "a filename can not have a '/'")
+		return
+	}
+	file, ok := apiLookup(w, r, filename)
+	if !ok {
+		return
+	}
+
+	if len(to) > 0 && to != file.Filename {
+		err := du.Rename(r.Context(), file.Filename, to)
+		if err == dbutil.ErrExists {
+			apiFail(w, r, 409, fmt.Sprintf("%s already exists", to))
+			return
+		} else if err != nil {
+			apiServerErr(w, r, err)
+			return
+		}
+		log.Printf("[%s] renamed to [%s] by %s", file.Filename, to, r.RemoteAddr)
+		if file, err = du.GetFileByFilename(r.Context(), to); err != nil {
+			apiServerErr(w, r, err)
+			return
+		}
+	}
+	if req.Keywords != nil || len(req.Add) > 0 || len(req.Remove) > 0 {
+		info := file.Metadata
+		if req.Keywords != nil {
+			info.Keywords = nil
+			info.AddKeywords(*req.Keywords...)
+		}
+		info.AddKeywords(req.Add...)
+		info.RemoveKeywords(req.Remove...)
+		if err := du.UpdateInfo(r.Context(), file.Filename, info); err != nil {
+			apiServerErr(w, r, err)
+			return
+		}
+	}
+
+	file, err := du.GetFileByFilename(r.Context(), file.Filename)
+	if err != nil {
+		apiServerErr(w, r, err)
+		return
+	}
+	apiRespond(w, r, 200, newAPIFile(file))
+}
+
+// apiDeleteFile puts the file stored as filename in the trash
+func apiDeleteFile(w http.ResponseWriter, r *http.Request, filename string) {
+	file, ok := apiLookup(w, r, filename)
+	if !ok {
+		return
+	}
+	info := file.Metadata
+	info.Trash(r.RemoteAddr, time.Now())
+	if err := du.UpdateInfo(r.Context(), file.Filename, info); err != nil {
+		apiServerErr(w, r, err)
+		return
+	}
+	log.Printf("[%s] put in the trash by %s", file.Filename, r.RemoteAddr)
+	httplog.LogRequest(r, 204)
+	w.WriteHeader(204)
+}
+
+// apiCounts answers with how many files have each keyword, or extension
+func apiCounts(w http.ResponseWriter, r *http.Request, of string) {
+	get := du.GetKeywords
+	if of == "extensions" {
+		get = du.GetExtensions
+	}
+	kp, err := get(r.Context())
+	if err != nil {
+		apiServerErr(w, r, err)
+		return
+	}
+	type count struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	counts := []count{}
+	for _, ic := range kp {
+		counts = append(counts, count{ic.Id, ic.Value})
+	}
+	apiRespond(w, r, 200, counts)
+}
+
+// apiLookup gets the file stored as filename, or sends the error response, if
+// it is not ok. Files in the trash are not found, and expired ones are gone.
+func apiLookup(w http.ResponseWriter, r *http.Request, filename string) (types.File, bool) {
+	file, err := getFile(r.Context(), filename)
+	if err == dbutil.ErrNotFound {
+		apiFail(w, r, 404, fmt.Sprintf("%s not found", filename))
+		return file, false
+	} else if err != nil {
+		apiServerErr(w, r, err)
+		return file, false
+	}
+	if file.Metadata.IsExpired(time.Now()) {
+		apiFail(w, r, 410, fmt.Sprintf("%s has expired", filename))
+		return file, false
+	}
+	return file, true
+}
+
+func apiRespond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	httplog.LogRequest(r, status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error: %s", err)
+	}
+}
+
+func apiFail(w http.ResponseWriter, r *http.Request, status int, message string) {
+	var e apiError
+	e.Error.Status = status
+	e.Error.Message = message
+	apiRespond(w, r, status, e)
+}
+
+// apiServerErr logs e, which is not for the client to see
+func apiServerErr(w http.ResponseWriter, r *http.Request, e error) {
+	log.Printf("Error: %s", e)
+	apiFail(w, r, 503, "the store is not available")
+}
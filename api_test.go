@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/imgsrv/dbutil"
+)
+
+// decode the JSON body, failing the test if it is not
+func decode(t *testing.T, body string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		t.Fatalf("%s: %q", err, body)
+	}
+}
+
+func TestAPIUpload(t *testing.T) {
+	ts := testServer(t)
+
+	res, body := do(t, ts, "POST", apiPrefix+"files?filename=Upload.png&keywords=a,b", strings.NewReader("contents"), nil)
+	if res.StatusCode != 201 {
+		t.Fatalf("POST: %d %q", res.StatusCode, body)
+	}
+	if actual := res.Header.Get("Location"); actual != apiPrefix+"files/upload.png" {
+		t.Errorf("Location %q", actual)
+	}
+	var file apiFile
+	decode(t, body, &file)
+	if file.Filename != "upload.png" || file.Size != uint64(len("contents")) || file.URL != "/f/upload.png" ||
+		!reflect.DeepEqual(file.Keywords, []string{"a", "b"}) {
+		t.Errorf("POST answered %#v", file)
+	}
+
+	res, body = do(t, ts, "POST", apiPrefix+"files?filename=upload.png", strings.NewReader("again"), nil)
+	var e apiError
+	decode(t, body, &e)
+	if res.StatusCode != 409 || e.Error.Status != 409 {
+		t.Errorf("POST of a name taken: %d %q", res.StatusCode, body)
+	}
+	if res, body = do(t, ts, "POST", apiPrefix+"files", strings.NewReader("nameless"), nil); res.StatusCode != 400 {
+		t.Errorf("POST without a filename: %d %q", res.StatusCode, body)
+	}
+}
+
+func TestAPIListFiles(t *testing.T) {
+	ts := testServer(t)
+	for _, name := range []string{"one.png", "two.png", "three.gif"} {
+		upload(t, ts, "/f/"+name+"?keywords=all", name)
+	}
+
+	var list struct {
+		Files []apiFile
+		Next  string
+	}
+	res, body := do(t, ts, "GET", apiPrefix+"files?limit=2", nil, nil)
+	decode(t, body, &list)
+	if res.StatusCode != 200 || len(list.Files) != 2 || list.Files[0].Filename != "three.gif" {
+		t.Fatalf("GET the first page: %d %q", res.StatusCode, body)
+	}
+	if list.Next != apiPrefix+"files?limit=2&offset=2" {
+		t.Errorf("next page %q", list.Next)
+	}
+	_, body = do(t, ts, "GET", list.Next, nil, nil)
+	list.Files, list.Next = nil, ""
+	decode(t, body, &list)
+	if len(list.Files) != 1 || list.Files[0].Filename != "one.png" || len(list.Next) > 0 {
+		t.Errorf("GET the last page: %q", body)
+	}
+
+	for query, expected := range map[string]int{
+		"ext=png":      2,
+		"ext=.GIF":     1,
+		"name=tw":      1,
+		"keyword=all":  3,
+		"keyword=none": 0,
+	} {
+		list.Files = nil
+		_, body = do(t, ts, "GET", apiPrefix+"files?"+query, nil, nil)
+		decode(t, body, &list)
+		if len(list.Files) != expected {
+			t.Errorf("GET ?%s: %d files, expected %d", query, len(list.Files), expected)
+		}
+	}
+	for _, query := range []string{"ext=png&name=one", "limit=0", "limit=101", "offset=-1", "before=yesterday"} {
+		if res, body := do(t, ts, "GET", apiPrefix+"files?"+query, nil, nil); res.StatusCode != 400 {
+			t.Errorf("GET ?%s: %d %q, expected a 400", query, res.StatusCode, body)
+		}
+	}
+}
+
+func TestAPIUpdateFile(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/before.png?keywords=a,b", "contents")
+	upload(t, ts, "/f/taken.png", "other")
+
+	res, body := do(t, ts, "PATCH", apiPrefix+"files/before.png",
+		strings.NewReader(`{"add": ["c"], "remove": ["a"], "filename": "After.png"}`), nil)
+	if res.StatusCode != 200 {
+		t.Fatalf("PATCH: %d %q", res.StatusCode, body)
+	}
+	var file apiFile
+	decode(t, body, &file)
+	if file.Filename != "after.png" || !reflect.DeepEqual(file.Keywords, []string{"b", "c"}) ||
+		!reflect.DeepEqual(file.Renamed, []string{"before.png"}) || file.Modified == nil {
+		t.Errorf("PATCH answered %#v", file)
+	}
+
+	for patch, expected := range map[string]int{
+		`{"filename": "taken.png"}`: 409,
+		`{"filename": "a/b.png"}`:   400,
+		`{"keywords": `:             400,
+	} {
+		if res, body := do(t, ts, "PATCH", apiPrefix+"files/after.png", strings.NewReader(patch), nil); res.StatusCode != expected {
+			t.Errorf("PATCH %s: %d %q, expected %d", patch, res.StatusCode, body, expected)
+		}
+	}
+	if res, _ := do(t, ts, "PATCH", apiPrefix+"files/missing.png", strings.NewReader(`{}`), nil); res.StatusCode != 404 {
+		t.Errorf("PATCH of a missing file: %d", res.StatusCode)
+	}
+}
+
+func TestAPIDeleteFile(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/deleted.png?keywords=gone", "contents")
+
+	if res, body := do(t, ts, "DELETE", apiPrefix+"files/deleted.png", nil, nil); res.StatusCode != 204 {
+		t.Fatalf("DELETE: %d %q", res.StatusCode, body)
+	}
+	if res, _ := do(t, ts, "GET", apiPrefix+"files/deleted.png", nil, nil); res.StatusCode != 404 {
+		t.Errorf("GET after DELETE: %d", res.StatusCode)
+	}
+	trash, err := du.GetTrash(context.Background(), dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Filename != "deleted.png" {
+		t.Errorf("the trash has %#v", trash)
+	}
+}
+
+func TestAPICounts(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/a.png?keywords=x,y", "a")
+	upload(t, ts, "/f/b.png?keywords=x", "b")
+
+	var counts []struct {
+		Name  string
+		Count int
+	}
+	_, body := do(t, ts, "GET", apiPrefix+"keywords", nil, nil)
+	decode(t, body, &counts)
+	if len(counts) != 2 || counts[0].Name != "x" || counts[0].Count != 2 || counts[1].Name != "y" || counts[1].Count != 1 {
+		t.Errorf("GET keywords: %q", body)
+	}
+	counts = nil
+	_, body = do(t, ts, "GET", apiPrefix+"extensions", nil, nil)
+	decode(t, body, &counts)
+	if len(counts) != 1 || counts[0].Name != "png" || counts[0].Count != 2 {
+		t.Errorf("GET extensions: %q", body)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	ts := testServer(t)
+	for _, req := range []struct {
+		method, path string
+		expected     int
+	}{
+		{"GET", apiPrefix + "nothing", 404},
+		{"GET", apiPrefix + "files/missing.png", 404},
+		{"PUT", apiPrefix + "files", 405},
+		{"POST", apiPrefix + "files/a.png", 405},
+		{"POST", apiPrefix + "keywords", 405},
+	} {
+		res, body := do(t, ts, req.method, req.path, nil, nil)
+		var e apiError
+		decode(t, body, &e)
+		if res.StatusCode != req.expected || e.Error.Status != req.expected || len(e.Error.Message) == 0 {
+			t.Errorf("%s %s: %d %q, expected %d", req.method, req.path, res.StatusCode, body, req.expected)
+		}
+	}
+}
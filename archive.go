@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vbatts/imgsrv/config"
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/types"
+)
+
+// manifestName is the first entry of an archive, listing the rest
+const manifestName = "manifest.json"
+
+// archived is a manifest entry: a stored file, and where its contents are in
+// the archive
+type archived struct {
+	Path string
+	File types.File
+}
+
+/*
+imgsrv [flags] export [-o backup.tar.gz] [-gzip] [-keywords a,b] [-after date] [-before date] [-incremental state]
+
+Write every file, with each of its earlier revisions, into a tar archive, for
+import into any DbHandler. The archive starts with a manifest.json of the
+types.File of each entry, followed by their contents.
+
+The files can be narrowed down to those with any of the keywords, or uploaded
+in a range of dates (like 2006-01-02, or RFC 3339). With -incremental, only the
+files uploaded or changed since the time kept in the state file are written,
+and the state file is updated once the export is done. Removals are not
+carried by the archive.
+*/
+func runExport(c *config.Config, args []string) error {
+	var (
+		output      string
+		compress    bool
+		keywords    string
+		after       string
+		before      string
+		incremental string
+	)
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&output, "o", "-", "File to write the archive to, or - for stdout")
+	fs.BoolVar(&compress, "gzip", false, "Compress the archive with gzip")
+	fs.StringVar(&keywords, "keywords", "", "Only the files with any of these keywords (comma delimited)")
+	fs.StringVar(&after, "after", "", "Only the files uploaded at or after this date")
+	fs.StringVar(&before, "before", "", "Only the files uploaded before this date")
+	fs.StringVar(&incremental, "incremental", "", "State file of the last export, to only write what changed since")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		f       filter
+		started = time.Now()
+		err     error
+	)
+	if len(keywords) > 0 {
+		f.keywords = strings.Split(strings.ToLower(keywords), ",")
+	}
+	if f.after, err = parseDate(after); err != nil {
+		return err
+	}
+	if f.before, err = parseDate(before); err != nil {
+		return err
+	}
+	if len(incremental) > 0 {
+		buf, err := ioutil.ReadFile(incremental)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if f.changed, err = parseDate(strings.TrimSpace(string(buf))); err != nil {
+			return fmt.Errorf("export: %s: %s", incremental, err)
+		}
+	}
+
+	h, err := openHandler(c, c.DbHandler)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	var out io.WriteCloser = os.Stdout
+	if output != "-" {
+		if out, err = os.Create(output); err != nil {
+			return err
+		}
+	}
+	if err := export(context.Background(), h, out, compress, f); err != nil {
+		out.Close()
+		if output != "-" {
+			os.Remove(output)
+		}
+		return err
+	}
+	if err := out.Close(); err != nil {
+		if output != "-" {
+			os.Remove(output)
+		}
+		return err
+	}
+
+	if len(incremental) > 0 {
+		return ioutil.WriteFile(incremental, []byte(started.Format(time.RFC3339Nano)+"\n"), 0644)
+	}
+	return nil
+}
+
+// filter is which files to export. The zero filter is all of them.
+type filter struct {
+	keywords      []string  // any of these
+	after, before time.Time // uploaded in this range, where not zero
+	changed       time.Time // uploaded or changed since, where not zero
+}
+
+// match is whether the file, the current revision, passes the filter
+func (f filter) match(file types.File) bool {
+	if len(f.keywords) > 0 {
+		found := false
+		for _, k := range f.keywords {
+			found = found || file.Metadata.HasKeyword(k)
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.after.IsZero() && file.Metadata.TimeStamp.Before(f.after) {
+		return false
+	}
+	if !f.before.IsZero() && !file.Metadata.TimeStamp.Before(f.before) {
+		return false
+	}
+	if !f.changed.IsZero() && !file.UploadDate.After(f.changed) && !file.Metadata.Modified.After(f.changed) {
+		return false
+	}
+	return true
+}
+
+// parseDate reads a date, or a full RFC 3339 time. An empty one is zero.
+func parseDate(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// export writes the archive of the files in h that pass the filter to w
+func export(ctx context.Context, h dbutil.Handler, w io.Writer, compress bool, f filter) error {
+	files, err := h.GetFiles(ctx, dbutil.Page{})
+	if err != nil {
+		return err
+	}
+	trash, err := h.GetTrash(ctx, dbutil.Page{})
+	if err != nil {
+		return err
+	}
+	files = append(files, trash...)
+
+	var (
+		manifest []archived
+		seen     = map[string]bool{}
+	)
+	for _, file := range files {
+		if seen[file.Filename] || !f.match(file) {
+			continue
+		}
+		seen[file.Filename] = true
+		revisions, err := h.GetRevisions(ctx, file.Filename)
+		if err != nil {
+			return err
+		}
+		for _, rev := range revisions {
+			manifest = append(manifest, archived{
+				Path: fmt.Sprintf("files/%06d", len(manifest)+1),
+				File: rev,
+			})
+		}
+	}
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(buf)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(buf); err != nil {
+		return err
+	}
+
+	// revisions are numbered in the order they were listed, oldest first
+	n := 0
+	for i, a := range manifest {
+		if i == 0 || manifest[i-1].File.Filename != a.File.Filename {
+			n = 0
+		}
+		n++
+		if err := exportFile(ctx, h, tw, a, n); err != nil {
+			return fmt.Errorf("export: [%s] revision %d: %s", a.File.Filename, n, err)
+		}
+		log.Printf("[%d/%d] %s: exported %d bytes", i+1, len(manifest), a.File.Filename, a.File.Length)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("export: %d files and revisions", len(manifest))
+	return nil
+}
+
+// exportFile writes the contents of revision n of the archived file to tw
+func exportFile(ctx context.Context, h dbutil.Handler, tw *tar.Writer, a archived, n int) error {
+	in, err := h.OpenRevision(ctx, a.File.Filename, n)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    a.Path,
+		Mode:    0644,
+		Size:    int64(a.File.Length),
+		ModTime: a.File.UploadDate,
+	})
+	if err != nil {
+		return err
+	}
+	// a short read would leave the archive unusable, so stop there
+	if _, err := io.CopyN(tw, in, int64(a.File.Length)); err != nil {
+		return fmt.Errorf("%s (try fsck)", err)
+	}
+	return nil
+}
+
+/*
+imgsrv [flags] import [-i backup.tar.gz]
+
+Restore the files from an archive made by export, compressed or not, into the
+DbHandler. Revisions already there, by md5 and upload date, are skipped, so
+that a full archive and then the incremental ones since can be imported in
+turn.
+*/
+func runImport(c *config.Config, args []string) error {
+	var input string
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(&input, "i", "-", "File to read the archive from, or - for stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var in io.ReadCloser = os.Stdin
+	if input != "-" {
+		var err error
+		if in, err = os.Open(input); err != nil {
+			return err
+		}
+	}
+	defer in.Close()
+
+	h, err := openHandler(c, c.DbHandler)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	return restore(context.Background(), h, in)
+}
+
+// restore imports the archive read from r into h
+func restore(ctx context.Context, h dbutil.Handler, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return err
+	}
+	if hdr.Name != manifestName {
+		return fmt.Errorf("import: the archive starts with %q, rather than %s", hdr.Name, manifestName)
+	}
+	var manifest []archived
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("import: %s: %s", manifestName, err)
+	}
+	files := map[string]types.File{}
+	for _, a := range manifest {
+		files[a.Path] = a.File
+	}
+
+	var imported, skipped, failed int
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		file, ok := files[hdr.Name]
+		if !ok {
+			return fmt.Errorf("import: %s is not in the manifest", hdr.Name)
+		}
+		progress := fmt.Sprintf("[%d/%d] %s", i+1, len(manifest), file.Filename)
+
+		ok, err = importFile(ctx, h, tr, file)
+		switch {
+		case err != nil:
+			log.Printf("%s: FAILED: %s", progress, err)
+			failed++
+		case ok:
+			log.Printf("%s: imported %d bytes", progress, file.Length)
+			imported++
+		default:
+			log.Printf("%s: already present", progress)
+			skipped++
+		}
+	}
+
+	log.Printf("import: %d imported, %d skipped, %d failed", imported, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("import: %d files failed", failed)
+	}
+	return nil
+}
+
+/*
+importFile stores file, read from r, as a revision in h, unless h has it
+already. An earlier revision is stored alongside the ones in h, and a current
+one as a new revision of what h has by the name, if anything.
+*/
+func importFile(ctx context.Context, h dbutil.Handler, r io.Reader, file types.File) (bool, error) {
+	revisions, err := h.GetRevisions(ctx, file.Filename)
+	if err != nil && err != dbutil.ErrNotFound {
+		return false, err
+	}
+	for i, rev := range revisions {
+		if rev.Md5 != file.Md5 || !sameTime(rev.UploadDate, file.UploadDate) {
+			continue
+		}
+		// bring the metadata of a current one up to date
+		if i == len(revisions)-1 && !file.Metadata.IsSuperseded() && !sameInfo(rev.Metadata, file.Metadata) {
+			return true, h.UpdateInfo(ctx, file.Filename, file.Metadata)
+		}
+		return false, nil
+	}
+
+	create := h.Create
+	if len(revisions) > 0 && !file.Metadata.IsSuperseded() {
+		create = h.CreateRevision
+	}
+	out, err := create(ctx, file.Filename)
+	if err != nil {
+		return false, err
+	}
+	info := file.Metadata
+	out.SetMeta(&info)
+	if uds, ok := out.(dbutil.UploadDateSetter); ok {
+		uds.SetUploadDate(file.UploadDate)
+	}
+	sum := md5.New()
+	if _, err := io.Copy(out, io.TeeReader(r, sum)); err != nil {
+		out.Close()
+		removeWritten(ctx, h, file.Filename, revisions)
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		return false, err
+	}
+	if read := hex.EncodeToString(sum.Sum(nil)); read != file.Md5 {
+		if err := removeWritten(ctx, h, file.Filename, revisions); err != nil {
+			log.Printf("import: %s: %s", file.Filename, err)
+		}
+		return false, fmt.Errorf("read md5 %s, but the archive has %s", read, file.Md5)
+	}
+	return true, nil
+}
+
+// removeWritten removes the revision of filename written since h had the
+// revisions before, if any, so that a failed write leaves nothing behind
+func removeWritten(ctx context.Context, h dbutil.Handler, filename string, before []types.File) error {
+	n, _, err := written(ctx, h, filename, before)
+	if err != nil || n == 0 {
+		return err
+	}
+	return h.RemoveRevision(ctx, filename, n)
+}
+
+// written finds the revision of filename written since h had the revisions
+// before, and its number for OpenRevision, or 0 if there is none
+func written(ctx context.Context, h dbutil.Handler, filename string, before []types.File) (int, types.File, error) {
+	after, err := h.GetRevisions(ctx, filename)
+	if err == dbutil.ErrNotFound {
+		return 0, types.File{}, nil
+	} else if err != nil {
+		return 0, types.File{}, err
+	}
+	for i, rev := range after {
+		if i == len(before) || rev.Md5 != before[i].Md5 || !sameTime(rev.UploadDate, before[i].UploadDate) {
+			return i + 1, rev, nil
+		}
+	}
+	return 0, types.File{}, nil
+}
+
+// sameTime is whether a and b are the same, to the millisecond that some
+// DbHandlers keep
+func sameTime(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d < time.Millisecond && d > -time.Millisecond
+}
+
+// sameInfo is whether the metadata is the same, as far as it can be changed
+// in place
+func sameInfo(a, b types.Info) bool {
+	return strings.Join(a.Keywords, ",") == strings.Join(b.Keywords, ",") &&
+		strings.Join(a.Renamed, ",") == strings.Join(b.Renamed, ",") &&
+		sameTime(a.Deleted, b.Deleted) &&
+		sameTime(a.Expires, b.Expires)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/types"
+)
+
+func md5sum(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestImportFileFailure(t *testing.T) {
+	ctx := context.Background()
+	h := dbutil.Handles["memory"]
+	if err := h.Init(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	uploaded := time.Now().Add(-time.Hour).Round(time.Millisecond)
+	file := types.File{Filename: "imported.png", Md5: md5sum("first"), UploadDate: uploaded}
+	if ok, err := importFile(ctx, h, strings.NewReader("first"), file); !ok || err != nil {
+		t.Fatalf("importFile = %v, %v", ok, err)
+	}
+
+	for name, r := range map[string]io.Reader{
+		"an md5 mismatch": strings.NewReader("not second"),
+		"a read error":    io.MultiReader(strings.NewReader("sec"), iotest.ErrReader(errors.New("torn"))),
+	} {
+		file := types.File{Filename: "imported.png", Md5: md5sum("second"), UploadDate: uploaded.Add(time.Minute)}
+		if _, err := importFile(ctx, h, r, file); err == nil {
+			t.Errorf("importFile with %s succeeded", name)
+		}
+		revs, err := h.GetRevisions(ctx, "imported.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != 1 || revs[0].Md5 != md5sum("first") || revs[0].Metadata.IsSuperseded() {
+			t.Errorf("after %s, the revisions are %#v", name, revs)
+		}
+	}
+}
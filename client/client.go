@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 )
@@ -65,3 +66,23 @@ func PutFileFromPath(uri, file_path string, params map[string]string) (path stri
 
 	return string(bytes), nil
 }
+
+// RenameFile moves the file from one name to another on the server at
+// remotehost, returning the path of its new name
+func RenameFile(remotehost, from, to string) (path string, err error) {
+	uri := remotehost + "/f/" + url.PathEscape(from) + "?rename=" + url.QueryEscape(to)
+	resp, err := http.Post(uri, "application/octet-stream", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return string(bytes), ErrorNotOK
+	}
+
+	return string(bytes), nil
+}
@@ -10,11 +10,23 @@ type Config struct {
 	Server        bool   // Run as server, if different than false (server)
 	Ip            string // Bind address, if different than 0.0.0.0 (server)
 	Port          string // listen port, if different than '7777' (server)
-	DbHandler     string // "mongo" (server)
-	MongoHost     string // mongoDB host, if different than 'localhost' (server)
+	DbHandler     string // "mongo", "mongodb", "fs", "bolt", "s3" or "memory" (server)
+	DataDir       string // directory to store files in, for the "fs" and "bolt" DbHandlers (server)
+	MongoHost     string // mongoDB host or mongodb:// URI, if different than 'localhost' (server)
 	MongoDbName   string // mongoDB db name, if different than 'filesrv' (server)
 	MongoUsername string // mongoDB username, if any (server)
 	MongoPassword string // mongoDB password, if any (server)
+	S3Endpoint    string // S3-compatible endpoint URL, for the "s3" DbHandler (server)
+	S3Bucket      string // S3 bucket to store files in (server)
+	S3Region      string // S3 region, if different than 'us-east-1' (server)
+	S3AccessKey   string // S3 access key (server)
+	S3SecretKey   string // S3 secret key (server)
+	S3PathStyle   bool   // address the bucket in the path, as MinIO expects (server)
+
+	TrashRetention string // how long deleted files stay in the trash, like "720h", if different than 30 days (server)
+	Versioned      bool   // keep earlier revisions of a file uploaded again under the same name (server)
+	ScrubInterval  string // how often to check every stored file against its md5 and length, like "168h", if ever (server)
+	Quarantine     bool   // put files that fail the check in the trash (server, fsck)
 
 	RemoteHost string // imgsrv server to push files to (client)
 
@@ -57,6 +69,9 @@ func (c *Config) Merge(other *Config) error {
 	if len(other.DbHandler) > 0 {
 		c.DbHandler = other.DbHandler
 	}
+	if len(other.DataDir) > 0 {
+		c.DataDir = other.DataDir
+	}
 	if len(other.MongoHost) > 0 {
 		c.MongoHost = other.MongoHost
 	}
@@ -69,6 +84,36 @@ func (c *Config) Merge(other *Config) error {
 	if len(other.MongoPassword) > 0 {
 		c.MongoPassword = other.MongoPassword
 	}
+	if len(other.S3Endpoint) > 0 {
+		c.S3Endpoint = other.S3Endpoint
+	}
+	if len(other.S3Bucket) > 0 {
+		c.S3Bucket = other.S3Bucket
+	}
+	if len(other.S3Region) > 0 {
+		c.S3Region = other.S3Region
+	}
+	if len(other.S3AccessKey) > 0 {
+		c.S3AccessKey = other.S3AccessKey
+	}
+	if len(other.S3SecretKey) > 0 {
+		c.S3SecretKey = other.S3SecretKey
+	}
+	if other.S3PathStyle {
+		c.S3PathStyle = other.S3PathStyle
+	}
+	if len(other.TrashRetention) > 0 {
+		c.TrashRetention = other.TrashRetention
+	}
+	if other.Versioned {
+		c.Versioned = other.Versioned
+	}
+	if len(other.ScrubInterval) > 0 {
+		c.ScrubInterval = other.ScrubInterval
+	}
+	if other.Quarantine {
+		c.Quarantine = other.Quarantine
+	}
 	if len(other.RemoteHost) > 0 && len(c.RemoteHost) == 0 {
 		c.RemoteHost = other.RemoteHost
 	}
@@ -0,0 +1,1033 @@
+/*
+Package blobstore implements the bulk of a dbutil.Handler, for backends that
+only know how to store opaque blobs.
+
+The metadata for every file is kept in memory, and persisted by the Backend
+as a single index document whenever it changes. This suits a single imgsrv
+process per store, which is what the "fs" and "s3" handlers are for. Every
+upload, change and removal writes the whole index again, at a few hundred
+bytes a file, so these handlers are for stores of some thousands of files,
+not millions. On S3, that is a PUT of the whole index each time.
+
+Blobs are content-addressed: an upload with the same md5 and length as one
+already stored refers to the existing blob, rather than storing another copy,
+and a blob is only deleted once the last entry referring to it is removed.
+*/
+package blobstore
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/types"
+)
+
+var (
+	errNotWriting = errors.New("blobstore: file is not open for writing")
+	errNotLister  = errors.New("blobstore: the backend can not list its blobs")
+)
+
+// Backend stores the blobs, and the index describing them
+type Backend interface {
+	// Put stores size bytes from r as the blob id
+	Put(ctx context.Context, id string, r io.Reader, size int64) error
+	// Get fetches the blob id
+	Get(ctx context.Context, id string) (io.ReadCloser, error)
+	// Delete removes the blob id
+	Delete(ctx context.Context, id string) error
+
+	// LoadIndex returns the last saved index, or nil if there is none yet
+	LoadIndex() ([]byte, error)
+	// SaveIndex persists the index
+	SaveIndex(buf []byte) error
+}
+
+// RangeGetter is optionally implemented by Backends that can fetch a blob
+// from an offset, for Seeks on Backends whose blobs are not io.Seekers
+type RangeGetter interface {
+	GetRange(ctx context.Context, id string, offset int64) (io.ReadCloser, error)
+}
+
+// Lister is optionally implemented by Backends that can list the blobs they
+// store, for finding the Orphans among them
+type Lister interface {
+	List(ctx context.Context) (ids []string, err error)
+}
+
+// Entry is a stored file, as recorded in the index. Entries with the same
+// contents share the blob Id.
+type Entry struct {
+	Id   string
+	File types.File
+}
+
+// Handle is a dbutil.Handler, save for Init, on top of a Backend.
+// Embedders call Setup from their Init.
+type Handle struct {
+	// TempDir is where uploads are spooled to before they're handed to the
+	// Backend. It defaults to os.TempDir().
+	TempDir string
+
+	backend Backend
+
+	// wmu is held for each change to the index in turn, while it is saved
+	// and the blobs it no longer refers to are deleted. mu is only held, by
+	// the writer, to swap in the changed entries, so that readers do not
+	// wait on the Backend. Either is enough to read h.entries.
+	wmu      sync.Mutex
+	mu       sync.RWMutex
+	entries  []Entry
+	keywords map[string]int  // tallies for the tag clouds, kept up to date
+	exts     map[string]int  // as entries are added and removed
+	reserved map[string]bool // names being written since CreateNew
+
+	// random is what GetRandomFile picks from: the files in the listings,
+	// sorted by Metadata.Random, for each of the scopes of randomScopes
+	random map[string][]*types.File
+}
+
+// Setup loads the index from b, and uses it for all further operations
+func (h *Handle) Setup(b Backend) error {
+	buf, err := b.LoadIndex()
+	if err != nil {
+		return err
+	}
+
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.backend = b
+	h.entries = nil
+	h.keywords = map[string]int{}
+	h.exts = map[string]int{}
+	h.reserved = map[string]bool{}
+	h.random = nil // sorted all at once below, rather than one by one
+	if buf != nil {
+		if err := json.Unmarshal(buf, &h.entries); err != nil {
+			return err
+		}
+	}
+	for _, e := range h.entries {
+		h.tally(e.File, 1)
+	}
+	h.random = randomIndex(h.entries)
+	return nil
+}
+
+// tally adds delta to the counts for the file's keywords and extension, and
+// adds the file to or removes it from h.random to match, unless it is hidden.
+// The caller must hold h.mu.
+func (h *Handle) tally(f types.File, delta int) {
+	if f.Metadata.Hidden() {
+		return
+	}
+	if h.random != nil {
+		h.index(f, delta)
+	}
+	for _, k := range f.Metadata.Keywords {
+		h.keywords[k] += delta
+		if h.keywords[k] <= 0 {
+			delete(h.keywords, k)
+		}
+	}
+	if len(f.Filename) > 0 {
+		s := strings.Split(f.Filename, ".")
+		ext := s[len(s)-1] // get the last segment of the split
+		h.exts[ext] += delta
+		if h.exts[ext] <= 0 {
+			delete(h.exts, ext)
+		}
+	}
+}
+
+func (h *Handle) Close() error {
+	return nil
+}
+
+// saveIndex hands entries to the backend, as the index. The caller must hold
+// h.wmu.
+func (h *Handle) saveIndex(entries []Entry) error {
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return h.backend.SaveIndex(buf)
+}
+
+// swap makes entries, once saved, the index, tallying out the files that were
+// removed or changed and tallying in those that were added or changed. The
+// caller must hold h.wmu.
+func (h *Handle) swap(entries []Entry, out, in []types.File) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = entries
+	for _, f := range out {
+		h.tally(f, -1)
+	}
+	for _, f := range in {
+		h.tally(f, 1)
+	}
+}
+
+// latest returns the most recently uploaded entry by this name. The caller
+// must hold h.mu or h.wmu.
+func (h *Handle) latest(filename string) (e Entry, ok bool) {
+	for _, this := range h.entries {
+		if this.File.Filename != filename {
+			continue
+		}
+		if !ok || this.File.UploadDate.After(e.File.UploadDate) {
+			e, ok = this, true
+		}
+	}
+	return e, ok
+}
+
+// find collects the page of files matching fn, most recent first, leaving out
+// the trash and earlier revisions
+func (h *Handle) find(ctx context.Context, page dbutil.Page, fn func(f types.File) bool) ([]types.File, error) {
+	return h.search(ctx, page, func(f types.File) bool {
+		return !f.Metadata.Hidden() && fn(f)
+	})
+}
+
+// search collects the page of files matching fn, most recent first
+func (h *Handle) search(ctx context.Context, page dbutil.Page, fn func(f types.File) bool) (files []types.File, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, e := range h.entries {
+		if fn(e.File) {
+			files = append(files, e.File)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Metadata.TimeStamp.After(files[j].Metadata.TimeStamp)
+	})
+	return page.Slice(files), nil
+}
+
+func (h *Handle) Open(ctx context.Context, filename string) (dbutil.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	e, ok := h.latest(strings.ToLower(filename))
+	h.mu.RUnlock()
+	if !ok {
+		return nil, dbutil.ErrNotFound
+	}
+
+	// the blob is only fetched on the first Read, so that opening a file just
+	// to Seek to the end for its size is cheap
+	return &file{h: h, ctx: ctx, e: e}, nil
+}
+
+func (h *Handle) Create(ctx context.Context, filename string) (dbutil.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	id, err := newId()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(h.TempDir, id)
+	if err != nil {
+		return nil, err
+	}
+	return &file{
+		h:       h,
+		ctx:     ctx,
+		tmp:     tmp,
+		e:       Entry{Id: id, File: types.File{Filename: strings.ToLower(filename)}},
+		sum:     md5.New(),
+		writing: true,
+	}, nil
+}
+
+func (h *Handle) CreateNew(ctx context.Context, filename string) (dbutil.File, error) {
+	filename = strings.ToLower(filename)
+	h.mu.Lock()
+	if _, ok := h.latest(filename); ok || h.reserved[filename] {
+		h.mu.Unlock()
+		return nil, dbutil.ErrExists
+	}
+	h.reserved[filename] = true
+	h.mu.Unlock()
+
+	f, err := h.Create(ctx, filename)
+	if err != nil {
+		h.release(filename)
+		return nil, err
+	}
+	f.(*file).reserved = true
+	return f, nil
+}
+
+func (h *Handle) Replace(ctx context.Context, filename string) (dbutil.File, error) {
+	f, err := h.Create(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	f.(*file).mode = replaceOthers
+	return f, nil
+}
+
+func (h *Handle) CreateRevision(ctx context.Context, filename string) (dbutil.File, error) {
+	f, err := h.Create(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	f.(*file).mode = reviseOthers
+	return f, nil
+}
+
+func (h *Handle) OpenRevision(ctx context.Context, filename string, n int) (dbutil.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	revs := h.revisions(strings.ToLower(filename))
+	h.mu.RUnlock()
+	if n < 1 || n > len(revs) {
+		return nil, dbutil.ErrNotFound
+	}
+	return &file{h: h, ctx: ctx, e: revs[n-1]}, nil
+}
+
+// revisions are the entries stored as filename, oldest first. The caller must
+// hold h.mu.
+func (h *Handle) revisions(filename string) (revs []Entry) {
+	for _, e := range h.entries {
+		if e.File.Filename == filename {
+			revs = append(revs, e)
+		}
+	}
+	sort.SliceStable(revs, func(i, j int) bool {
+		return revs[i].File.UploadDate.Before(revs[j].File.UploadDate)
+	})
+	return revs
+}
+
+// release lets filename be created with CreateNew again
+func (h *Handle) release(filename string) {
+	h.mu.Lock()
+	delete(h.reserved, filename)
+	h.mu.Unlock()
+}
+
+func (h *Handle) Remove(ctx context.Context, filename string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	filename = strings.ToLower(filename)
+
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	var (
+		kept    []Entry
+		removed []Entry
+		out     []types.File
+	)
+	for _, e := range h.entries {
+		if e.File.Filename == filename {
+			removed = append(removed, e)
+			out = append(out, e.File)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := h.saveIndex(kept); err != nil {
+		return err
+	}
+	h.swap(kept, out, nil)
+	return h.drop(ctx, removed)
+}
+
+func (h *Handle) RemoveRevision(ctx context.Context, filename string, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	filename = strings.ToLower(filename)
+
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	old := h.entries
+	// the positions in old of the revisions, in the order of revisions()
+	var revs []int
+	for i, e := range old {
+		if e.File.Filename == filename {
+			revs = append(revs, i)
+		}
+	}
+	sort.SliceStable(revs, func(i, j int) bool {
+		return old[revs[i]].File.UploadDate.Before(old[revs[j]].File.UploadDate)
+	})
+	if n < 1 || n > len(revs) {
+		return dbutil.ErrNotFound
+	}
+
+	removed := old[revs[n-1]]
+	out := []types.File{removed.File}
+	var in []types.File
+	// the one before the current revision takes its place
+	previous := -1
+	if n == len(revs) && n > 1 && !removed.File.Metadata.IsSuperseded() {
+		previous = revs[n-2]
+	}
+	entries := make([]Entry, 0, len(old)-1)
+	for i, e := range old {
+		if i == revs[n-1] {
+			continue
+		}
+		if i == previous {
+			out = append(out, e.File)
+			e.File.Metadata.Superseded = time.Time{}
+			in = append(in, e.File)
+		}
+		entries = append(entries, e)
+	}
+	if err := h.saveIndex(entries); err != nil {
+		return err
+	}
+	h.swap(entries, out, in)
+	return h.drop(ctx, []Entry{removed})
+}
+
+func (h *Handle) UpdateInfo(ctx context.Context, filename string, info types.Info) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { *i = info })
+}
+
+func (h *Handle) AddKeywords(ctx context.Context, filename string, keywords ...string) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { i.AddKeywords(keywords...) })
+}
+
+func (h *Handle) RemoveKeywords(ctx context.Context, filename string, keywords ...string) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { i.RemoveKeywords(keywords...) })
+}
+
+// updateInfo changes the metadata of the entries for filename with fn
+func (h *Handle) updateInfo(ctx context.Context, filename string, fn func(info *types.Info)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	return h.change(strings.ToLower(filename), func(f *types.File) bool {
+		if f.Metadata.IsSuperseded() {
+			return false
+		}
+		fn(&f.Metadata)
+		return true
+	})
+}
+
+func (h *Handle) Rename(ctx context.Context, from, to string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	from, to = strings.ToLower(from), strings.ToLower(to)
+
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	h.mu.RLock()
+	_, taken := h.latest(to)
+	taken = taken || h.reserved[to]
+	h.mu.RUnlock()
+	if taken {
+		return dbutil.ErrExists
+	}
+	return h.change(from, func(f *types.File) bool {
+		f.Filename = to
+		f.Metadata.RenamedFrom(from, to)
+		return true
+	})
+}
+
+// change applies fn to the entries for filename, and sets those it changed
+// modified. The caller must hold h.wmu.
+func (h *Handle) change(filename string, fn func(f *types.File) bool) error {
+	now := time.Now().Round(0) // as it would be read back from the index
+	entries := make([]Entry, len(h.entries))
+	var out, in []types.File
+	for i, e := range h.entries {
+		if e.File.Filename == filename {
+			out = append(out, e.File)
+			// not to share the slices with the old entry
+			e.File.Metadata.Keywords = append([]string{}, e.File.Metadata.Keywords...)
+			e.File.Metadata.Renamed = append([]string{}, e.File.Metadata.Renamed...)
+			if fn(&e.File) {
+				e.File.Metadata.Modified = now
+			}
+			in = append(in, e.File)
+		}
+		entries[i] = e
+	}
+	if len(in) == 0 {
+		return dbutil.ErrNotFound
+	}
+	if err := h.saveIndex(entries); err != nil {
+		return err
+	}
+	h.swap(entries, out, in)
+	return nil
+}
+
+// refs counts the entries referring to the blob id. The caller must hold h.mu
+// or h.wmu.
+func (h *Handle) refs(id string) (count int) {
+	for _, e := range h.entries {
+		if e.Id == id {
+			count++
+		}
+	}
+	return count
+}
+
+// Find files by their MD5 checksum
+func (h *Handle) FindFilesByMd5(ctx context.Context, md5 string, page dbutil.Page) ([]types.File, error) {
+	return h.find(ctx, page, func(f types.File) bool {
+		return f.Md5 == md5
+	})
+}
+
+// Case-insensitive pattern match for file name
+func (h *Handle) FindFilesByPatt(ctx context.Context, filenamePat string, page dbutil.Page) ([]types.File, error) {
+	re, err := regexp.Compile("(?i)" + filenamePat)
+	if err != nil {
+		return nil, err
+	}
+	return h.find(ctx, page, func(f types.File) bool {
+		return re.MatchString(f.Filename)
+	})
+}
+
+// Files that have this keyword
+func (h *Handle) FindFilesByKeyword(ctx context.Context, keyword string, page dbutil.Page) ([]types.File, error) {
+	keyword = strings.ToLower(keyword)
+	return h.find(ctx, page, func(f types.File) bool {
+		for _, k := range f.Metadata.Keywords {
+			if k == keyword {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Get a page of all the files.
+func (h *Handle) GetFiles(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+	return h.find(ctx, page, func(f types.File) bool { return true })
+}
+
+// Get a page of the files in the trash.
+func (h *Handle) GetTrash(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+	return h.search(ctx, page, func(f types.File) bool {
+		return f.Metadata.IsDeleted() && !f.Metadata.IsSuperseded()
+	})
+}
+
+// Get the files that have expired by t.
+func (h *Handle) GetExpired(ctx context.Context, t time.Time) ([]types.File, error) {
+	return h.search(ctx, dbutil.Page{}, func(f types.File) bool {
+		return f.Metadata.IsExpired(t) && !f.Metadata.IsSuperseded()
+	})
+}
+
+// Orphans lists the blobs that no entry refers to, if the Backend is a Lister
+func (h *Handle) Orphans(ctx context.Context) ([]string, error) {
+	l, ok := h.backend.(Lister)
+	if !ok {
+		return nil, errNotLister
+	}
+	ids, err := l.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var orphans []string
+	for _, id := range ids {
+		if h.refs(id) == 0 {
+			orphans = append(orphans, id)
+		}
+	}
+	return orphans, nil
+}
+
+// Count the filename matches
+func (h *Handle) CountFiles(ctx context.Context, filename string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	filename = strings.ToLower(filename)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	count := 0
+	for _, e := range h.entries {
+		if e.File.Filename == filename {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Get one file back, by searching by file name
+func (h *Handle) GetFileByFilename(ctx context.Context, filename string) (types.File, error) {
+	if err := ctx.Err(); err != nil {
+		return types.File{}, err
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	e, ok := h.latest(strings.ToLower(filename))
+	if !ok {
+		return types.File{}, dbutil.ErrNotFound
+	}
+	return e.File, nil
+}
+
+func (h *Handle) GetFileByFormerName(ctx context.Context, filename string) (types.File, error) {
+	if err := ctx.Err(); err != nil {
+		return types.File{}, err
+	}
+	filename = strings.ToLower(filename)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var (
+		f  types.File
+		ok bool
+	)
+	for _, e := range h.entries {
+		info := e.File.Metadata
+		if info.HasRenamed(filename) && (!ok || info.Modified.After(f.Metadata.Modified)) {
+			f, ok = e.File, true
+		}
+	}
+	if !ok {
+		return types.File{}, dbutil.ErrNotFound
+	}
+	return f, nil
+}
+
+// Pick a file from the index, by its Metadata.Random.
+func (h *Handle) GetRandomFile(ctx context.Context, pick dbutil.Pick) (types.File, error) {
+	if err := ctx.Err(); err != nil {
+		return types.File{}, err
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	files := h.random[randomScope(pick)]
+	i := sort.Search(len(files), func(i int) bool {
+		return files[i].Metadata.Random >= pick.Random
+	})
+	// on from there, wrapping around once, to the first that pick.Match
+	// does not rule out for what the scope leaves unchecked
+	for n := range files {
+		if f := files[(i+n)%len(files)]; pick.Match(*f) {
+			return *f, nil
+		}
+	}
+	return types.File{}, dbutil.ErrNotFound
+}
+
+// randomScopes are the scopes of h.random the file is picked from: all of the
+// files, those with each of its keywords, and those with its extension
+func randomScopes(f types.File) []string {
+	s := strings.Split(f.Filename, ".")
+	scopes := []string{"", "ext:" + s[len(s)-1]}
+	for _, k := range f.Metadata.Keywords {
+		scopes = append(scopes, "k:"+k)
+	}
+	return scopes
+}
+
+// randomScope is the scope of h.random that pick is made from
+func randomScope(pick dbutil.Pick) string {
+	if len(pick.Keyword) > 0 {
+		return "k:" + strings.ToLower(pick.Keyword)
+	} else if len(pick.Extension) > 0 {
+		return "ext:" + strings.ToLower(pick.Extension)
+	}
+	return ""
+}
+
+// randomIndex is h.random for the entries
+func randomIndex(entries []Entry) map[string][]*types.File {
+	random := map[string][]*types.File{}
+	for _, e := range entries {
+		f := e.File
+		if f.Metadata.Hidden() {
+			continue
+		}
+		for _, scope := range randomScopes(f) {
+			random[scope] = append(random[scope], &f)
+		}
+	}
+	for _, files := range random {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Metadata.Random < files[j].Metadata.Random
+		})
+	}
+	return random
+}
+
+// index adds the file to h.random, or removes it for a negative delta. The
+// caller must hold h.mu.
+func (h *Handle) index(f types.File, delta int) {
+	for _, scope := range randomScopes(f) {
+		files := h.random[scope]
+		i := sort.Search(len(files), func(i int) bool {
+			return files[i].Metadata.Random >= f.Metadata.Random
+		})
+		if delta > 0 {
+			files = append(files, nil)
+			copy(files[i+1:], files[i:])
+			files[i] = &f
+		} else {
+			for ; i < len(files) && files[i].Metadata.Random == f.Metadata.Random; i++ {
+				if files[i].Filename == f.Filename && files[i].UploadDate.Equal(f.UploadDate) {
+					files = append(files[:i], files[i+1:]...)
+					break
+				}
+			}
+		}
+		if len(files) == 0 {
+			delete(h.random, scope)
+		} else {
+			h.random[scope] = files
+		}
+	}
+}
+
+func (h *Handle) GetRevisions(ctx context.Context, filename string) ([]types.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	revs := h.revisions(strings.ToLower(filename))
+	if len(revs) == 0 {
+		return nil, dbutil.ErrNotFound
+	}
+	files := make([]types.File, len(revs))
+	for i, e := range revs {
+		files[i] = e.File
+	}
+	return files, nil
+}
+
+// Check whether this types.File filename is stored
+func (h *Handle) HasFileByFilename(ctx context.Context, filename string) (bool, error) {
+	c, err := h.CountFiles(ctx, filename)
+	if err != nil {
+		return false, err
+	}
+	return c > 0, nil
+}
+
+// get a list of file extensions and their frequency count
+func (h *Handle) GetExtensions(ctx context.Context) ([]types.IdCount, error) {
+	return h.count(ctx, "ext", h.exts)
+}
+
+// get a list of keywords and their frequency count
+func (h *Handle) GetKeywords(ctx context.Context) ([]types.IdCount, error) {
+	return h.count(ctx, "k", h.keywords)
+}
+
+// count lists the tallies in counts, sorted by value
+func (h *Handle) count(ctx context.Context, root string, counts map[string]int) (kp []types.IdCount, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	for id, value := range counts {
+		kp = append(kp, types.IdCount{Id: id, Value: value, Root: root})
+	}
+	h.mu.RUnlock()
+	sort.Slice(kp, func(i, j int) bool { return kp[i].Id < kp[j].Id })
+	return kp, nil
+}
+
+// addShared records a completed upload in the index, if there is already a
+// blob with the same contents for it to refer to
+func (h *Handle) addShared(ctx context.Context, e Entry, mode storeMode) (ok bool, err error) {
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	for _, this := range h.entries {
+		if this.File.Md5 == e.File.Md5 && this.File.Length == e.File.Length {
+			e.Id = this.Id
+			return true, h.put(ctx, e, mode)
+		}
+	}
+	return false, nil
+}
+
+// add records a completed upload in the index
+func (h *Handle) add(ctx context.Context, e Entry, mode storeMode) error {
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	return h.put(ctx, e, mode)
+}
+
+// storeMode is what becomes of the entries of the same name, when a file is
+// stored
+type storeMode int
+
+const (
+	keepOthers    storeMode = iota // stored alongside them
+	replaceOthers                  // removed
+	reviseOthers                   // kept as earlier revisions
+)
+
+// put adds e to the index, doing with the entries of the same name as mode
+// says. The caller must hold h.wmu.
+func (h *Handle) put(ctx context.Context, e Entry, mode storeMode) error {
+	entries := make([]Entry, 0, len(h.entries)+1)
+	var (
+		removed []Entry
+		out     []types.File
+	)
+	for _, this := range h.entries {
+		if this.File.Filename != e.File.Filename || mode == keepOthers {
+			entries = append(entries, this)
+		} else if mode == replaceOthers {
+			removed = append(removed, this)
+			out = append(out, this.File)
+		} else {
+			if !this.File.Metadata.IsSuperseded() {
+				out = append(out, this.File)
+				this.File.Metadata.Superseded = time.Now().Round(0)
+			}
+			entries = append(entries, this)
+		}
+	}
+	entries = append(entries, e)
+	if err := h.saveIndex(entries); err != nil {
+		return err
+	}
+	h.swap(entries, out, []types.File{e.File})
+	return h.drop(ctx, removed)
+}
+
+// drop deletes the blobs of the entries just removed from the index, that
+// nothing refers to any more. The caller must hold h.wmu.
+func (h *Handle) drop(ctx context.Context, removed []Entry) error {
+	deleted := map[string]bool{}
+	for _, e := range removed {
+		if deleted[e.Id] || h.refs(e.Id) > 0 {
+			continue // still shared by another name, or already deleted
+		}
+		if err := h.backend.Delete(ctx, e.Id); err != nil {
+			return err
+		}
+		deleted[e.Id] = true
+	}
+	return nil
+}
+
+func newId() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// file is a dbutil.File read from, or spooled for, the Backend
+type file struct {
+	h   *Handle
+	ctx context.Context
+	e   Entry
+
+	// reading
+	rc     io.ReadCloser
+	offset int64
+
+	// writing
+	tmp        *os.File
+	sum        hash.Hash
+	uploadDate time.Time
+	writing    bool
+	reserved   bool      // the name is held until the file is stored
+	mode       storeMode // what becomes of the files of the same name
+	err        error
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.writing {
+		return 0, errors.New("blobstore: file is open for writing")
+	}
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(f.e.File.Length) {
+		return 0, io.EOF
+	}
+	if f.rc == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.rc.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+// open fetches the blob again, from the current offset
+func (f *file) open() (err error) {
+	if rg, ok := f.h.backend.(RangeGetter); ok {
+		f.rc, err = rg.GetRange(f.ctx, f.e.Id, f.offset)
+		return err
+	}
+	if f.rc, err = f.h.backend.Get(f.ctx, f.e.Id); err != nil {
+		return err
+	}
+	_, err = io.CopyN(ioutil.Discard, f.rc, f.offset)
+	return err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.writing {
+		return 0, errors.New("blobstore: file is open for writing")
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.e.File.Length)
+	default:
+		return f.offset, errors.New("blobstore: invalid whence")
+	}
+	if offset < 0 {
+		return f.offset, errors.New("blobstore: negative position")
+	}
+	if offset == f.offset {
+		return offset, nil
+	}
+
+	if s, ok := f.rc.(io.Seeker); ok {
+		if _, err := s.Seek(offset, io.SeekStart); err != nil {
+			return f.offset, err
+		}
+	} else if f.rc != nil {
+		// fetched again from the new offset, on the next Read
+		f.rc.Close()
+		f.rc = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, errNotWriting
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	if err := f.ctx.Err(); err != nil {
+		f.err = err
+		return 0, err
+	}
+	n, err := f.tmp.Write(p)
+	f.sum.Write(p[:n])
+	f.e.File.Length += uint64(n)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Close completes the upload, if the file was created for writing
+func (f *file) Close() error {
+	if !f.writing {
+		if f.rc == nil {
+			return nil
+		}
+		return f.rc.Close()
+	}
+	f.writing = false
+	if f.reserved {
+		defer f.h.release(f.e.File.Filename)
+	}
+	defer os.Remove(f.tmp.Name())
+	defer f.tmp.Close()
+	if f.err != nil {
+		return f.err
+	}
+
+	f.e.File.Md5 = hex.EncodeToString(f.sum.Sum(nil))
+	f.e.File.UploadDate = f.uploadDate
+	if f.uploadDate.IsZero() {
+		f.e.File.UploadDate = time.Now()
+	}
+	if ok, err := f.h.addShared(f.ctx, f.e, f.mode); ok || err != nil {
+		return err
+	}
+
+	// A concurrent upload of the same contents may also get this far, and
+	// store a second copy. That only costs the space.
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.h.backend.Put(f.ctx, f.e.Id, f.tmp, int64(f.e.File.Length)); err != nil {
+		return err
+	}
+	if err := f.h.add(f.ctx, f.e, f.mode); err != nil {
+		f.h.backend.Delete(context.Background(), f.e.Id)
+		return err
+	}
+	return nil
+}
+
+func (f *file) SetUploadDate(t time.Time) {
+	f.uploadDate = t
+}
+
+func (f *file) GetMeta(result interface{}) error {
+	buf, err := json.Marshal(f.e.File.Metadata)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, result)
+}
+
+func (f *file) SetMeta(metadata interface{}) {
+	if !f.writing {
+		f.err = errNotWriting
+		return
+	}
+	buf, err := json.Marshal(metadata)
+	if err == nil {
+		var info types.Info
+		if err = json.Unmarshal(buf, &info); err == nil {
+			f.e.File.Metadata = info
+			return
+		}
+	}
+	if f.err == nil {
+		f.err = err
+	}
+}
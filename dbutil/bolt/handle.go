@@ -0,0 +1,1142 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/types"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	dbutil.Handles["bolt"] = &boltHandle{}
+}
+
+const defaultChunkSize = 255 * 1024
+
+var (
+	filesBucket   = []byte("files")  // id -> types.File
+	chunksBucket  = []byte("chunks") // id + n -> data
+	blobsBucket   = []byte("blobs")  // md5 -> id of the chunks + reference count
+	countsBucket  = []byte("counts") // keyword/ext tallies, by index name
+	indexesBucket = []byte("index")  // secondary indexes, by index name
+
+	filenameIndex  = []byte("filename")  // filename + id
+	md5Index       = []byte("md5")       // md5 + id
+	keywordIndex   = []byte("keyword")   // keyword + id
+	extIndex       = []byte("ext")       // extension + id
+	timestampIndex = []byte("timestamp") // metadata.timestamp + id
+	renamedIndex   = []byte("renamed")   // former filename + id
+	trashIndex     = []byte("trash")     // metadata.timestamp + id, of the deleted files
+	expiresIndex   = []byte("expires")   // metadata.expires + id, of the files that expire
+	randomIndex    = []byte("random")    // scope + metadata.random + id, of the files in the listings
+
+	errNotWriting = errors.New("bolt: file is not open for writing")
+)
+
+type dbConfig struct {
+	Path string // path to the database file
+}
+
+type boltHandle struct {
+	config dbConfig
+	db     *bbolt.DB
+
+	mu       sync.Mutex
+	reserved map[string]bool // names being written since CreateNew
+}
+
+func (h *boltHandle) Init(config []byte, err error) error {
+	if err != nil {
+		return err
+	}
+
+	h.config = dbConfig{}
+	if err := json.Unmarshal(config, &h.config); err != nil {
+		return err
+	}
+	if len(h.config.Path) == 0 {
+		return errors.New("bolt: no database path provided")
+	}
+	h.reserved = map[string]bool{}
+
+	if err := os.MkdirAll(filepath.Dir(h.config.Path), 0755); err != nil {
+		return err
+	}
+	h.db, err = bbolt.Open(h.config.Path, 0644, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	return h.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, chunksBucket, blobsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		for _, parent := range [][]byte{countsBucket, indexesBucket} {
+			b, err := tx.CreateBucketIfNotExists(parent)
+			if err != nil {
+				return err
+			}
+			for _, name := range [][]byte{filenameIndex, md5Index, keywordIndex, extIndex, timestampIndex, renamedIndex, trashIndex, expiresIndex, randomIndex} {
+				if _, err := b.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (h *boltHandle) Close() error {
+	if h.db == nil {
+		return nil
+	}
+	return h.db.Close()
+}
+
+// view runs fn in a read-only transaction, unless ctx is already done
+func (h *boltHandle) view(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return h.db.View(fn)
+}
+
+// update runs fn in a read-write transaction, unless ctx is already done
+func (h *boltHandle) update(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return h.db.Update(fn)
+}
+
+func (h *boltHandle) Open(ctx context.Context, filename string) (dbutil.File, error) {
+	var f file
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		ids := lookup(tx, filenameIndex, []byte(strings.ToLower(filename)))
+		files, err := getFiles(tx, ids)
+		if err != nil {
+			return err
+		}
+		latest, ok := latestUpload(files)
+		if !ok {
+			return dbutil.ErrNotFound
+		}
+		f = file{h: h, ctx: ctx, id: ids[latest], doc: files[latest]}
+		f.blob, _, _ = getBlob(tx, f.doc.Md5)
+		if f.blob == nil {
+			return errors.New("bolt: missing blob")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (h *boltHandle) Create(ctx context.Context, filename string) (dbutil.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "imgsrv-bolt")
+	if err != nil {
+		return nil, err
+	}
+	return &file{
+		h:       h,
+		ctx:     ctx,
+		tmp:     tmp,
+		doc:     types.File{Filename: strings.ToLower(filename), ChunkSize: defaultChunkSize},
+		sum:     md5.New(),
+		writing: true,
+	}, nil
+}
+
+func (h *boltHandle) CreateNew(ctx context.Context, filename string) (dbutil.File, error) {
+	filename = strings.ToLower(filename)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reserved[filename] {
+		return nil, dbutil.ErrExists
+	}
+	if exists, err := h.HasFileByFilename(ctx, filename); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, dbutil.ErrExists
+	}
+
+	f, err := h.Create(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	h.reserved[filename] = true
+	f.(*file).reserved = true
+	return f, nil
+}
+
+func (h *boltHandle) Replace(ctx context.Context, filename string) (dbutil.File, error) {
+	f, err := h.Create(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	f.(*file).replace = true
+	return f, nil
+}
+
+func (h *boltHandle) CreateRevision(ctx context.Context, filename string) (dbutil.File, error) {
+	f, err := h.Create(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	f.(*file).revise = true
+	return f, nil
+}
+
+func (h *boltHandle) OpenRevision(ctx context.Context, filename string, n int) (dbutil.File, error) {
+	var f file
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		ids, files, err := revisions(tx, strings.ToLower(filename))
+		if err != nil {
+			return err
+		}
+		if n < 1 || n > len(files) {
+			return dbutil.ErrNotFound
+		}
+		f = file{h: h, ctx: ctx, id: ids[n-1], doc: files[n-1]}
+		f.blob, _, _ = getBlob(tx, f.doc.Md5)
+		if f.blob == nil {
+			return errors.New("bolt: missing blob")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// revisions are the ids and documents stored as filename, oldest first
+func revisions(tx *bbolt.Tx, filename string) ([][]byte, []types.File, error) {
+	ids := lookup(tx, filenameIndex, []byte(filename))
+	files, err := getFiles(tx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(byUploadDate{ids, files})
+	return ids, files, nil
+}
+
+// byUploadDate sorts the ids along with their documents
+type byUploadDate struct {
+	ids   [][]byte
+	files []types.File
+}
+
+func (s byUploadDate) Len() int { return len(s.ids) }
+func (s byUploadDate) Less(i, j int) bool {
+	return s.files[i].UploadDate.Before(s.files[j].UploadDate)
+}
+func (s byUploadDate) Swap(i, j int) {
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+	s.files[i], s.files[j] = s.files[j], s.files[i]
+}
+
+// release lets filename be created with CreateNew again
+func (h *boltHandle) release(filename string) {
+	h.mu.Lock()
+	delete(h.reserved, filename)
+	h.mu.Unlock()
+}
+
+func (h *boltHandle) Remove(ctx context.Context, filename string) error {
+	return h.update(ctx, func(tx *bbolt.Tx) error {
+		for _, id := range lookup(tx, filenameIndex, []byte(strings.ToLower(filename))) {
+			if err := removeFile(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (h *boltHandle) RemoveRevision(ctx context.Context, filename string, n int) error {
+	return h.update(ctx, func(tx *bbolt.Tx) error {
+		ids, files, err := revisions(tx, strings.ToLower(filename))
+		if err != nil {
+			return err
+		}
+		if n < 1 || n > len(files) {
+			return dbutil.ErrNotFound
+		}
+		if err := removeFile(tx, ids[n-1]); err != nil {
+			return err
+		}
+		if n < len(files) || n == 1 || files[n-1].Metadata.IsSuperseded() {
+			return nil
+		}
+		// the one before the current revision takes its place
+		return updateFile(tx, ids[n-2], func(f *types.File) {
+			f.Metadata.Superseded = time.Time{}
+		})
+	})
+}
+
+func (h *boltHandle) UpdateInfo(ctx context.Context, filename string, info types.Info) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { *i = info })
+}
+
+func (h *boltHandle) AddKeywords(ctx context.Context, filename string, keywords ...string) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { i.AddKeywords(keywords...) })
+}
+
+func (h *boltHandle) RemoveKeywords(ctx context.Context, filename string, keywords ...string) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { i.RemoveKeywords(keywords...) })
+}
+
+// updateInfo changes the metadata of the files stored as filename with fn
+func (h *boltHandle) updateInfo(ctx context.Context, filename string, fn func(info *types.Info)) error {
+	return h.update(ctx, func(tx *bbolt.Tx) error {
+		return change(tx, strings.ToLower(filename), func(f *types.File) bool {
+			if f.Metadata.IsSuperseded() {
+				return false
+			}
+			fn(&f.Metadata)
+			return true
+		})
+	})
+}
+
+func (h *boltHandle) Rename(ctx context.Context, from, to string) error {
+	from, to = strings.ToLower(from), strings.ToLower(to)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reserved[to] {
+		return dbutil.ErrExists
+	}
+	return h.update(ctx, func(tx *bbolt.Tx) error {
+		if len(lookup(tx, filenameIndex, []byte(to))) > 0 {
+			return dbutil.ErrExists
+		}
+		return change(tx, from, func(f *types.File) bool {
+			f.Filename = to
+			f.Metadata.RenamedFrom(from, to)
+			return true
+		})
+	})
+}
+
+// change applies fn to the files stored as filename, and sets those it
+// changed modified
+func change(tx *bbolt.Tx, filename string, fn func(f *types.File) bool) error {
+	ids := lookup(tx, filenameIndex, []byte(filename))
+	if len(ids) == 0 {
+		return dbutil.ErrNotFound
+	}
+	now := time.Now()
+	for _, id := range ids {
+		err := updateFile(tx, id, func(f *types.File) {
+			if fn(f) {
+				f.Metadata.Modified = now
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find files by their MD5 checksum
+func (h *boltHandle) FindFilesByMd5(ctx context.Context, md5 string, page dbutil.Page) ([]types.File, error) {
+	return h.findIndexed(ctx, md5Index, md5, page)
+}
+
+// Case-insensitive pattern match for file name
+func (h *boltHandle) FindFilesByPatt(ctx context.Context, filenamePat string, page dbutil.Page) ([]types.File, error) {
+	re, err := regexp.Compile("(?i)" + filenamePat)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []types.File
+	err = h.view(ctx, func(tx *bbolt.Tx) error {
+		c := tx.Bucket(indexesBucket).Bucket(filenameIndex).Cursor()
+		var ids [][]byte
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if name, id := splitKey(k); re.Match(name) {
+				ids = append(ids, id)
+			}
+		}
+		found, err := getFiles(tx, ids)
+		for _, f := range found {
+			if !f.Metadata.Hidden() {
+				files = append(files, f)
+			}
+		}
+		return err
+	})
+	sortByTimestamp(files)
+	return page.Slice(files), err
+}
+
+// Files that have this keyword
+func (h *boltHandle) FindFilesByKeyword(ctx context.Context, keyword string, page dbutil.Page) ([]types.File, error) {
+	return h.findIndexed(ctx, keywordIndex, strings.ToLower(keyword), page)
+}
+
+// Get a page of all the files, most recent first.
+func (h *boltHandle) GetFiles(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+	return h.newest(ctx, timestampIndex, page)
+}
+
+// Get a page of the files in the trash, most recent first.
+func (h *boltHandle) GetTrash(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+	return h.newest(ctx, trashIndex, page)
+}
+
+// Get the files that have expired by t.
+func (h *boltHandle) GetExpired(ctx context.Context, t time.Time) ([]types.File, error) {
+	var files []types.File
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		c := tx.Bucket(indexesBucket).Bucket(expiresIndex).Cursor()
+		end := timestampKey(t.Add(1), nil)
+		var ids [][]byte
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			ids = append(ids, k[8:])
+		}
+		var err error
+		files, err = getFiles(tx, ids)
+		return err
+	})
+	return files, err
+}
+
+// Orphans lists the ids of the chunks that no blob refers to.
+func (h *boltHandle) Orphans(ctx context.Context) ([]string, error) {
+	var orphans []string
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		blobs := map[string]bool{}
+		err := tx.Bucket(blobsBucket).ForEach(func(md5, v []byte) error {
+			blobs[string(v[:8])] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		c := tx.Bucket(chunksBucket).Cursor()
+		next := make([]byte, 8)
+		for k, _ := c.First(); k != nil; k, _ = c.Seek(next) {
+			if !blobs[string(k[:8])] {
+				orphans = append(orphans, hex.EncodeToString(k[:8]))
+			}
+			// on to the first chunk of the next id
+			binary.BigEndian.PutUint64(next, binary.BigEndian.Uint64(k[:8])+1)
+		}
+		return nil
+	})
+	return orphans, err
+}
+
+// newest walks back through index, of timestamp keys, for the page of files
+func (h *boltHandle) newest(ctx context.Context, index []byte, page dbutil.Page) ([]types.File, error) {
+	var files []types.File
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		c := tx.Bucket(indexesBucket).Bucket(index).Cursor()
+		k, _ := c.Last()
+		if !page.Before.IsZero() {
+			// step back from the first key at or after the cursor
+			if k, _ = c.Seek(timestampKey(page.Before, nil)); k != nil {
+				k, _ = c.Prev()
+			} else {
+				k, _ = c.Last()
+			}
+		}
+		for i := 0; k != nil && i < page.Offset; i++ {
+			k, _ = c.Prev()
+		}
+		var ids [][]byte
+		for ; k != nil && (page.Limit <= 0 || len(ids) < page.Limit); k, _ = c.Prev() {
+			ids = append(ids, k[8:])
+		}
+		var err error
+		files, err = getFiles(tx, ids)
+		return err
+	})
+	return files, err
+}
+
+// Pick a file by walking the random index, from pick.Random on.
+func (h *boltHandle) GetRandomFile(ctx context.Context, pick dbutil.Pick) (types.File, error) {
+	var f types.File
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		scope := randomScope(pick)
+		c := tx.Bucket(indexesBucket).Bucket(randomIndex).Cursor()
+		k, _ := c.Seek(randomKey(scope, pick.Random))
+		for wrapped := false; ; k, _ = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if k == nil || !bytes.HasPrefix(k, scope) {
+				if wrapped {
+					return dbutil.ErrNotFound
+				}
+				// on from the start of the scope, once
+				if k, _ = c.Seek(scope); k == nil || !bytes.HasPrefix(k, scope) {
+					return dbutil.ErrNotFound
+				}
+				wrapped = true
+			}
+			files, err := getFiles(tx, [][]byte{k[len(k)-8:]})
+			if err != nil {
+				return err
+			}
+			// the scope is narrowed down by one of the keyword and the
+			// extension, so any others are checked here
+			if pick.Match(files[0]) {
+				f = files[0]
+				return nil
+			}
+		}
+	})
+	return f, err
+}
+
+// Count the filename matches
+func (h *boltHandle) CountFiles(ctx context.Context, filename string) (int, error) {
+	var count int
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		count = len(lookup(tx, filenameIndex, []byte(strings.ToLower(filename))))
+		return nil
+	})
+	return count, err
+}
+
+// Get one file back, by searching by file name
+func (h *boltHandle) GetFileByFilename(ctx context.Context, filename string) (types.File, error) {
+	var f types.File
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		ids := lookup(tx, filenameIndex, []byte(strings.ToLower(filename)))
+		files, err := getFiles(tx, ids)
+		if err != nil {
+			return err
+		}
+		latest, ok := latestUpload(files)
+		if !ok {
+			return dbutil.ErrNotFound
+		}
+		f = files[latest]
+		return nil
+	})
+	return f, err
+}
+
+func (h *boltHandle) GetRevisions(ctx context.Context, filename string) ([]types.File, error) {
+	var files []types.File
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		_, files, err = revisions(tx, strings.ToLower(filename))
+		if err == nil && len(files) == 0 {
+			err = dbutil.ErrNotFound
+		}
+		return err
+	})
+	return files, err
+}
+
+func (h *boltHandle) GetFileByFormerName(ctx context.Context, filename string) (types.File, error) {
+	var f types.File
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		files, err := getFiles(tx, lookup(tx, renamedIndex, []byte(strings.ToLower(filename))))
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return dbutil.ErrNotFound
+		}
+		f = files[0]
+		for _, this := range files[1:] {
+			if this.Metadata.Modified.After(f.Metadata.Modified) {
+				f = this
+			}
+		}
+		return nil
+	})
+	return f, err
+}
+
+// Check whether this types.File filename is stored
+func (h *boltHandle) HasFileByFilename(ctx context.Context, filename string) (bool, error) {
+	c, err := h.CountFiles(ctx, filename)
+	if err != nil {
+		return false, err
+	}
+	return c > 0, nil
+}
+
+// get a list of file extensions and their frequency count
+func (h *boltHandle) GetExtensions(ctx context.Context) ([]types.IdCount, error) {
+	return h.counts(ctx, extIndex, "ext")
+}
+
+// get a list of keywords and their frequency count
+func (h *boltHandle) GetKeywords(ctx context.Context) ([]types.IdCount, error) {
+	return h.counts(ctx, keywordIndex, "k")
+}
+
+func (h *boltHandle) counts(ctx context.Context, index []byte, root string) (kp []types.IdCount, err error) {
+	err = h.view(ctx, func(tx *bbolt.Tx) error {
+		return tx.Bucket(countsBucket).Bucket(index).ForEach(func(k, v []byte) error {
+			kp = append(kp, types.IdCount{Id: string(k), Value: int(binary.BigEndian.Uint64(v)), Root: root})
+			return nil
+		})
+	})
+	return kp, err
+}
+
+func (h *boltHandle) findIndexed(ctx context.Context, index []byte, value string, page dbutil.Page) ([]types.File, error) {
+	var files []types.File
+	err := h.view(ctx, func(tx *bbolt.Tx) error {
+		var err error
+		files, err = getFiles(tx, lookup(tx, index, []byte(value)))
+		return err
+	})
+	sortByTimestamp(files)
+	return page.Slice(files), err
+}
+
+// lookup returns the ids stored under value in the index
+func lookup(tx *bbolt.Tx, index, value []byte) (ids [][]byte) {
+	c := tx.Bucket(indexesBucket).Bucket(index).Cursor()
+	prefix := append(append([]byte{}, value...), 0)
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ids = append(ids, append([]byte{}, k[len(prefix):]...))
+	}
+	return ids
+}
+
+func getFiles(tx *bbolt.Tx, ids [][]byte) ([]types.File, error) {
+	b := tx.Bucket(filesBucket)
+	files := make([]types.File, 0, len(ids))
+	for _, id := range ids {
+		var f types.File
+		if err := json.Unmarshal(b.Get(id), &f); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func latestUpload(files []types.File) (latest int, ok bool) {
+	for i := range files {
+		if !ok || files[i].UploadDate.After(files[latest].UploadDate) {
+			latest, ok = i, true
+		}
+	}
+	return latest, ok
+}
+
+func sortByTimestamp(files []types.File) {
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Metadata.TimeStamp.After(files[j].Metadata.TimeStamp)
+	})
+}
+
+// indexKey is the value, a NUL separator, and then the file id
+func indexKey(value string, id []byte) []byte {
+	return append(append([]byte(value), 0), id...)
+}
+
+func splitKey(k []byte) (value, id []byte) {
+	return k[:len(k)-9], k[len(k)-8:]
+}
+
+func timestampKey(t time.Time, id []byte) []byte {
+	k := make([]byte, 8, 16)
+	if t.After(time.Unix(0, 0)) {
+		binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	}
+	return append(k, id...)
+}
+
+func chunkKey(id []byte, n uint32) []byte {
+	k := make([]byte, 12)
+	copy(k, id)
+	binary.BigEndian.PutUint32(k[8:], n)
+	return k
+}
+
+func extension(filename string) string {
+	s := strings.Split(filename, ".")
+	return s[len(s)-1] // get the last segment of the split
+}
+
+// entries returns the values each index has for this file. The trash and
+// earlier revisions are only indexed by name.
+func entries(f types.File) map[string][]string {
+	if f.Metadata.Hidden() {
+		return map[string][]string{
+			string(filenameIndex): {f.Filename},
+			string(renamedIndex):  f.Metadata.Renamed,
+		}
+	}
+	return map[string][]string{
+		string(filenameIndex): {f.Filename},
+		string(md5Index):      {f.Md5},
+		string(keywordIndex):  f.Metadata.Keywords,
+		string(extIndex):      {extension(f.Filename)},
+		string(renamedIndex):  f.Metadata.Renamed,
+		string(randomIndex):   randomValues(f),
+	}
+}
+
+// randomValues are the file's entries in the random index, one in each scope
+// GetRandomFile picks from: all of the files, those with each of its
+// keywords, and those with its extension
+func randomValues(f types.File) []string {
+	picks := []dbutil.Pick{{}, {Extension: extension(f.Filename)}}
+	for _, k := range f.Metadata.Keywords {
+		picks = append(picks, dbutil.Pick{Keyword: k})
+	}
+	values := make([]string, len(picks))
+	for i, pick := range picks {
+		values[i] = string(randomKey(randomScope(pick), f.Metadata.Random))
+	}
+	return values
+}
+
+// randomScope is the prefix of the random index keys that pick is made from
+func randomScope(pick dbutil.Pick) []byte {
+	if len(pick.Keyword) > 0 {
+		return indexKey("k:"+strings.ToLower(pick.Keyword), nil)
+	} else if len(pick.Extension) > 0 {
+		return indexKey("ext:"+strings.ToLower(pick.Extension), nil)
+	}
+	return indexKey("", nil)
+}
+
+// randomKey is the scope, then r, so that the keys sort by r, negative first
+func randomKey(scope []byte, r int64) []byte {
+	k := make([]byte, len(scope)+8)
+	copy(k, scope)
+	binary.BigEndian.PutUint64(k[len(scope):], uint64(r)^1<<63)
+	return k
+}
+
+func addCount(tx *bbolt.Tx, index []byte, value string, delta int64) error {
+	b := tx.Bucket(countsBucket).Bucket(index)
+	var count int64
+	if v := b.Get([]byte(value)); v != nil {
+		count = int64(binary.BigEndian.Uint64(v))
+	}
+	count += delta
+	if count <= 0 {
+		return b.Delete([]byte(value))
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(count))
+	return b.Put([]byte(value), buf)
+}
+
+// putFile stores the document and all of its index entries
+func putFile(tx *bbolt.Tx, id []byte, f types.File) error {
+	buf, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(filesBucket).Put(id, buf); err != nil {
+		return err
+	}
+
+	indexes := tx.Bucket(indexesBucket)
+	for index, values := range entries(f) {
+		for _, v := range values {
+			if err := indexes.Bucket([]byte(index)).Put(indexKey(v, id), nil); err != nil {
+				return err
+			}
+			if index == string(keywordIndex) || index == string(extIndex) {
+				if err := addCount(tx, []byte(index), v, 1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if expires(f) {
+		if err := indexes.Bucket(expiresIndex).Put(timestampKey(f.Metadata.Expires, id), nil); err != nil {
+			return err
+		}
+	}
+	if index := listIndex(f); index != nil {
+		return indexes.Bucket(index).Put(timestampKey(f.Metadata.TimeStamp, id), nil)
+	}
+	return nil
+}
+
+// removeFile deletes the document, its chunks and all of its index entries
+func removeFile(tx *bbolt.Tx, id []byte) error {
+	files := tx.Bucket(filesBucket)
+	var f types.File
+	if err := json.Unmarshal(files.Get(id), &f); err != nil {
+		return err
+	}
+	if err := unindexFile(tx, id, f); err != nil {
+		return err
+	}
+	if err := releaseBlob(tx, f.Md5); err != nil {
+		return err
+	}
+	return files.Delete(id)
+}
+
+// updateFile changes the document with fn, and its index entries to match
+func updateFile(tx *bbolt.Tx, id []byte, fn func(f *types.File)) error {
+	var f types.File
+	if err := json.Unmarshal(tx.Bucket(filesBucket).Get(id), &f); err != nil {
+		return err
+	}
+	if err := unindexFile(tx, id, f); err != nil {
+		return err
+	}
+	fn(&f)
+	return putFile(tx, id, f)
+}
+
+// unindexFile deletes all of the document's index entries
+func unindexFile(tx *bbolt.Tx, id []byte, f types.File) error {
+	indexes := tx.Bucket(indexesBucket)
+	for index, values := range entries(f) {
+		for _, v := range values {
+			if err := indexes.Bucket([]byte(index)).Delete(indexKey(v, id)); err != nil {
+				return err
+			}
+			if index == string(keywordIndex) || index == string(extIndex) {
+				if err := addCount(tx, []byte(index), v, -1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if expires(f) {
+		if err := indexes.Bucket(expiresIndex).Delete(timestampKey(f.Metadata.Expires, id)); err != nil {
+			return err
+		}
+	}
+	if index := listIndex(f); index != nil {
+		return indexes.Bucket(index).Delete(timestampKey(f.Metadata.TimeStamp, id))
+	}
+	return nil
+}
+
+// listIndex is the timestamp index the file is listed in, if any
+func listIndex(f types.File) []byte {
+	if f.Metadata.IsSuperseded() {
+		return nil
+	}
+	if f.Metadata.IsDeleted() {
+		return trashIndex
+	}
+	return timestampIndex
+}
+
+// expires is whether the file is in the expires index. Earlier revisions go
+// with the current one instead.
+func expires(f types.File) bool {
+	return !f.Metadata.Expires.IsZero() && !f.Metadata.IsSuperseded()
+}
+
+// getBlob looks up the chunks for this md5, and how many files share them
+func getBlob(tx *bbolt.Tx, md5 string) (id []byte, refs uint64, ok bool) {
+	v := tx.Bucket(blobsBucket).Get([]byte(md5))
+	if v == nil {
+		return nil, 0, false
+	}
+	return append([]byte{}, v[:8]...), binary.BigEndian.Uint64(v[8:]), true
+}
+
+func putBlob(tx *bbolt.Tx, md5 string, id []byte, refs uint64) error {
+	v := make([]byte, 16)
+	copy(v, id)
+	binary.BigEndian.PutUint64(v[8:], refs)
+	return tx.Bucket(blobsBucket).Put([]byte(md5), v)
+}
+
+// releaseBlob drops a reference to the chunks for this md5, and deletes them
+// along with the last one
+func releaseBlob(tx *bbolt.Tx, md5 string) error {
+	id, refs, ok := getBlob(tx, md5)
+	if !ok {
+		return nil
+	}
+	if refs > 1 {
+		return putBlob(tx, md5, id, refs-1)
+	}
+	if err := deleteChunks(tx, id); err != nil {
+		return err
+	}
+	return tx.Bucket(blobsBucket).Delete([]byte(md5))
+}
+
+func deleteChunks(tx *bbolt.Tx, id []byte) error {
+	c := tx.Bucket(chunksBucket).Cursor()
+	for k, _ := c.Seek(id); k != nil && bytes.HasPrefix(k, id); k, _ = c.Seek(id) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file is a dbutil.File stored as chunks in the database.
+// Writes are spooled to a temporary file, and committed in a single
+// transaction on Close.
+type file struct {
+	h    *boltHandle
+	ctx  context.Context
+	id   []byte
+	blob []byte // id of the chunks, which files with the same md5 share
+	doc  types.File
+
+	// reading
+	offset int64
+	chunk  []byte
+
+	// writing
+	tmp        *os.File
+	sum        hash.Hash
+	uploadDate time.Time
+	writing    bool
+	reserved   bool // the name is held until the file is stored
+	replace    bool // the file takes the place of those of the same name
+	revise     bool // the files of the same name are kept as earlier revisions
+	err        error
+}
+
+func (f *file) Read(p []byte) (n int, err error) {
+	if f.writing {
+		return 0, errors.New("bolt: file is open for writing")
+	}
+	for len(p) > 0 {
+		if len(f.chunk) == 0 {
+			if f.offset >= int64(f.doc.Length) {
+				break
+			}
+			if err := f.ctx.Err(); err != nil {
+				return n, err
+			}
+			if f.chunk, err = f.getChunk(); err != nil {
+				return n, err
+			}
+		}
+		i := copy(p, f.chunk)
+		f.chunk = f.chunk[i:]
+		f.offset += int64(i)
+		p = p[i:]
+		n += i
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.writing {
+		return 0, errors.New("bolt: file is open for writing")
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.doc.Length)
+	default:
+		return f.offset, errors.New("bolt: invalid whence")
+	}
+	if offset < 0 {
+		return f.offset, errors.New("bolt: negative position")
+	}
+	if offset != f.offset {
+		f.offset = offset
+		f.chunk = nil
+	}
+	return offset, nil
+}
+
+// getChunk fetches the remainder of the chunk for the current offset
+func (f *file) getChunk() (data []byte, err error) {
+	n := uint32(f.offset / int64(f.doc.ChunkSize))
+	err = f.h.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(chunksBucket).Get(chunkKey(f.blob, n))
+		if v == nil {
+			return errors.New("bolt: missing chunk")
+		}
+		data = append([]byte{}, v[f.offset%int64(f.doc.ChunkSize):]...)
+		return nil
+	})
+	return data, err
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, errNotWriting
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	if err := f.ctx.Err(); err != nil {
+		f.err = err
+		return 0, err
+	}
+	n, err := f.tmp.Write(p)
+	f.sum.Write(p[:n])
+	f.doc.Length += uint64(n)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Close commits the upload, if the file was created for writing
+func (f *file) Close() error {
+	if !f.writing {
+		return nil
+	}
+	f.writing = false
+	if f.reserved {
+		defer f.h.release(f.doc.Filename)
+	}
+	defer os.Remove(f.tmp.Name())
+	defer f.tmp.Close()
+	if f.err != nil {
+		return f.err
+	}
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f.doc.Md5 = hex.EncodeToString(f.sum.Sum(nil))
+	f.doc.UploadDate = f.uploadDate
+	if f.uploadDate.IsZero() {
+		f.doc.UploadDate = time.Now()
+	}
+	return f.h.update(f.ctx, func(tx *bbolt.Tx) error {
+		old := lookup(tx, filenameIndex, []byte(f.doc.Filename))
+		// a plain Create may have stored the name in the meantime
+		if f.reserved && len(old) > 0 {
+			return dbutil.ErrExists
+		}
+		if err := f.store(tx); err != nil {
+			return err
+		}
+		if f.replace {
+			for _, id := range old {
+				if err := removeFile(tx, id); err != nil {
+					return err
+				}
+			}
+		}
+		if f.revise {
+			now := time.Now()
+			for _, id := range old {
+				err := updateFile(tx, id, func(doc *types.File) {
+					if !doc.Metadata.IsSuperseded() {
+						doc.Metadata.Superseded = now
+					}
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// store puts the spooled upload in the database
+func (f *file) store(tx *bbolt.Tx) error {
+	seq, err := tx.Bucket(filesBucket).NextSequence()
+	if err != nil {
+		return err
+	}
+	f.id = make([]byte, 8)
+	binary.BigEndian.PutUint64(f.id, seq)
+
+	// the contents are only stored once
+	if blob, refs, ok := getBlob(tx, f.doc.Md5); ok {
+		if err := putBlob(tx, f.doc.Md5, blob, refs+1); err != nil {
+			return err
+		}
+		return putFile(tx, f.id, f.doc)
+	}
+	if err := putBlob(tx, f.doc.Md5, f.id, 1); err != nil {
+		return err
+	}
+
+	chunks := tx.Bucket(chunksBucket)
+	buf := make([]byte, f.doc.ChunkSize)
+	for n := uint32(0); ; n++ {
+		i, err := io.ReadFull(f.tmp, buf)
+		if i > 0 {
+			if err := chunks.Put(chunkKey(f.id, n), append([]byte{}, buf[:i]...)); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return putFile(tx, f.id, f.doc)
+}
+
+func (f *file) SetUploadDate(t time.Time) {
+	f.uploadDate = t
+}
+
+func (f *file) GetMeta(result interface{}) error {
+	buf, err := json.Marshal(f.doc.Metadata)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, result)
+}
+
+func (f *file) SetMeta(metadata interface{}) {
+	if !f.writing {
+		f.err = errNotWriting
+		return
+	}
+	buf, err := json.Marshal(metadata)
+	if err == nil {
+		var info types.Info
+		if err = json.Unmarshal(buf, &info); err == nil {
+			f.doc.Metadata = info
+			return
+		}
+	}
+	if f.err == nil {
+		f.err = err
+	}
+}
@@ -0,0 +1,165 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/dbutil/dbutiltest"
+	"github.com/vbatts/imgsrv/types"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "imgsrv-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &boltHandle{}
+	if err := h.Init(json.Marshal(dbConfig{Path: filepath.Join(dir, "imgsrv.db")})); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// spans a few chunks
+	blob := bytes.Repeat([]byte("Hurp til you Derp"), defaultChunkSize/4)
+	for i, name := range []string{"Cat.GIF", "dog.gif"} {
+		f, err := h.Create(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.SetMeta(&types.Info{
+			Keywords:  []string{"pets"},
+			TimeStamp: time.Now().Add(time.Duration(i) * time.Second),
+		})
+		if _, err := f.Write(blob); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// identical contents are only stored once
+	if n := countChunks(t, h); n != len(blob)/defaultChunkSize+1 {
+		t.Errorf("expected the chunks of one copy, found %d", n)
+	}
+
+	f, err := h.Open(ctx, "CAT.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, blob) {
+		t.Errorf("read %d bytes, expected %d", len(buf), len(blob))
+	}
+
+	files, err := h.FindFilesByKeyword(ctx, "PETS", dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Filename != "dog.gif" || files[1].Md5 != files[0].Md5 {
+		t.Errorf("unexpected files %#v", files)
+	}
+
+	if err := h.Remove(ctx, "dog.gif"); err != nil {
+		t.Fatal(err)
+	}
+	ext, err := h.GetExtensions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ext) != 1 || ext[0].Id != "gif" || ext[0].Value != 1 || ext[0].Root != "ext" {
+		t.Errorf("unexpected extension counts %#v", ext)
+	}
+	files, err = h.GetFiles(ctx, dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Filename != "cat.gif" {
+		t.Errorf("unexpected files %#v", files)
+	}
+	if err := h.Remove(ctx, "cat.gif"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, h); n != 0 {
+		t.Errorf("expected the chunks to go with the last file, found %d", n)
+	}
+}
+
+func countChunks(t *testing.T, h *boltHandle) (n int) {
+	err := h.db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(chunksBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imgsrv-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &boltHandle{}
+	if err := h.Init(json.Marshal(dbConfig{Path: filepath.Join(dir, "imgsrv.db")})); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	dbutiltest.Run(t, h)
+}
+
+func TestOrphans(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "imgsrv-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &boltHandle{}
+	if err := h.Init(json.Marshal(dbConfig{Path: filepath.Join(dir, "imgsrv.db")})); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	dbutiltest.Put(t, h, "kept.gif", types.Info{TimeStamp: time.Now()}, "Hurp til you Derp")
+
+	// the chunks of an upload that lost its blob
+	orphan := []byte{0, 0, 0, 0, 0, 0, 0, 42}
+	err = h.db.Update(func(tx *bbolt.Tx) error {
+		for n := uint32(0); n < 2; n++ {
+			if err := tx.Bucket(chunksBucket).Put(chunkKey(orphan, n), []byte("lost")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := h.Orphans(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "000000000000002a" {
+		t.Errorf("Orphans = %q, expected only %q", ids, "000000000000002a")
+	}
+}
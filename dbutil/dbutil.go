@@ -1,7 +1,11 @@
 package dbutil
 
 import (
+	"context"
+	"errors"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/vbatts/imgsrv/types"
 )
@@ -9,34 +13,164 @@ import (
 // Handles are all the register backing Handlers
 var Handles = map[string]Handler{}
 
-// Handler is the means of getting "files" from the backing database
+var (
+	// ErrNotFound is returned by Handlers when no file matches the request
+	ErrNotFound = errors.New("file not found")
+	// ErrExists is returned by Handlers when CreateNew is given a filename
+	// that is already taken
+	ErrExists = errors.New("file already exists")
+)
+
+// Handler is the means of getting "files" from the backing database.
+// Implementations ought to pass the dbutiltest conformance suite.
+//
+// Every call, save Init and Close, takes a context.Context. Handlers give up
+// on the call once it is done, with its error, and so do the Files they
+// return, for the Reads and Writes that follow.
 type Handler interface {
 	Init(config []byte, err error) error
 	Close() error
 
-	Open(filename string) (File, error)
-	Create(filename string) (File, error)
-	Remove(filename string) error
+	Open(ctx context.Context, filename string) (File, error)
+	Create(ctx context.Context, filename string) (File, error)
+	// CreateNew is Create, only if filename is not stored, nor being
+	// created by another CreateNew, and otherwise fails with ErrExists.
+	// Handlers that can only tell once the upload is complete return
+	// ErrExists from the File's Close instead, having stored nothing.
+	CreateNew(ctx context.Context, filename string) (File, error)
+	// Replace is Create, but once the File is closed, it takes the place of
+	// whatever was stored as filename.
+	Replace(ctx context.Context, filename string) (File, error)
+	// CreateRevision is Replace, except that what was stored as filename is
+	// kept as an earlier revision, with its Metadata.Superseded set, rather
+	// than removed. Earlier revisions are only found by GetRevisions and
+	// OpenRevision, and go along with Rename and Remove of the current one.
+	CreateRevision(ctx context.Context, filename string) (File, error)
+	// OpenRevision opens revision n of filename, counting from 1 for the
+	// oldest. There being no such revision is ErrNotFound.
+	OpenRevision(ctx context.Context, filename string, n int) (File, error)
+	Remove(ctx context.Context, filename string) error
+	// RemoveRevision removes revision n of filename, counting as
+	// OpenRevision does. Removing the current revision makes the one
+	// before it current again. There being no such revision is ErrNotFound.
+	RemoveRevision(ctx context.Context, filename string, n int) error
+
+	// UpdateInfo, AddKeywords and RemoveKeywords change the metadata of the
+	// file stored as filename in place, without rewriting its contents, and
+	// set its Modified time. Earlier revisions keep the metadata they had.
+	// There being no such file is ErrNotFound.
+	UpdateInfo(ctx context.Context, filename string, info types.Info) error
+	AddKeywords(ctx context.Context, filename string, keywords ...string) error
+	RemoveKeywords(ctx context.Context, filename string, keywords ...string) error
+
+	// Rename moves the file stored as from to the name to, keeping its
+	// contents and metadata, and adding from to its Metadata.Renamed. There
+	// being no such file is ErrNotFound, and to being taken is ErrExists.
+	Rename(ctx context.Context, from, to string) error
+
+	// Files in the trash, with their Metadata.Deleted set, are left out of
+	// the listings (FindFilesBy*, GetFiles) and the keyword and extension
+	// counts, but are still looked up by name. GetTrash lists only them.
+	GetTrash(ctx context.Context, page Page) (files []types.File, err error)
+	// GetExpired lists the files whose Metadata.Expires is at or before t,
+	// whether they are in the trash or not. An earlier revision only expires
+	// along with the current one.
+	GetExpired(ctx context.Context, t time.Time) (files []types.File, err error)
 
-	//HasFileByMd5(md5 string) (exists bool, err error)
-	//HasFileByKeyword(keyword string) (exists bool, err error)
-	HasFileByFilename(filename string) (exists bool, err error)
-	FindFilesByKeyword(keyword string) (files []types.File, err error)
-	FindFilesByMd5(md5 string) (files []types.File, err error)
-	FindFilesByPatt(filenamePat string) (files []types.File, err error)
+	//HasFileByMd5(ctx context.Context, md5 string) (exists bool, err error)
+	//HasFileByKeyword(ctx context.Context, keyword string) (exists bool, err error)
+	HasFileByFilename(ctx context.Context, filename string) (exists bool, err error)
+	FindFilesByKeyword(ctx context.Context, keyword string, page Page) (files []types.File, err error)
+	FindFilesByMd5(ctx context.Context, md5 string, page Page) (files []types.File, err error)
+	FindFilesByPatt(ctx context.Context, filenamePat string, page Page) (files []types.File, err error)
 
-	CountFiles(filename string) (int, error)
+	CountFiles(ctx context.Context, filename string) (int, error)
+
+	GetFiles(ctx context.Context, page Page) (files []types.File, err error)
+	GetFileByFilename(ctx context.Context, filename string) (types.File, error)
+	// GetRevisions is every revision of the file stored as filename, oldest
+	// first, so that the last is the current one
+	GetRevisions(ctx context.Context, filename string) ([]types.File, error)
+	// GetFileByFormerName finds the most recently renamed file that was once
+	// stored as filename
+	GetFileByFormerName(ctx context.Context, filename string) (types.File, error)
+	// GetRandomFile picks one of the files in the listings that has not
+	// expired, as pick says. There being none to pick from is ErrNotFound.
+	GetRandomFile(ctx context.Context, pick Pick) (types.File, error)
+	GetExtensions(ctx context.Context) (kp []types.IdCount, err error)
+	GetKeywords(ctx context.Context) (kp []types.IdCount, err error)
+}
+
+// Page is the window of a listing to return. Listings are the most recent
+// first, by Metadata.TimeStamp, and the zero Page is all of it.
+type Page struct {
+	Limit  int       // at most this many files, when > 0
+	Offset int       // skip this many files first
+	Before time.Time // only files with a TimeStamp before this, when not zero
+}
 
-	GetFiles(limit int) (files []types.File, err error)
-	GetFileByFilename(filename string) (types.File, error)
-	GetExtensions() (kp []types.IdCount, err error)
-	GetKeywords() (kp []types.IdCount, err error)
+// Slice applies the Page to files already sorted most recent first, for
+// Handlers that can not do it as part of their query.
+func (p Page) Slice(files []types.File) []types.File {
+	if !p.Before.IsZero() {
+		i := 0
+		for i < len(files) && !files[i].Metadata.TimeStamp.Before(p.Before) {
+			i++
+		}
+		files = files[i:]
+	}
+	if p.Offset > 0 {
+		if p.Offset >= len(files) {
+			return nil
+		}
+		files = files[p.Offset:]
+	}
+	if p.Limit > 0 && len(files) > p.Limit {
+		files = files[:p.Limit]
+	}
+	return files
 }
 
-// File is what is stored and fetched from the backing database
+// Pick is how GetRandomFile chooses a file. Of the files it is narrowed down
+// to, it is the one with the least Metadata.Random at or above Random, or the
+// least of all, wrapping around, when none is. Random is to be random, as the
+// Metadata.Random of each file is, so that the pick is too.
+//
+// It is not a uniform pick, though, as that would take counting the files.
+// Each file is picked as often as Random falls in the gap between its
+// Metadata.Random and the one below it, and those gaps are only even on
+// average. With n files, one may come up several times as often as 1/n, and
+// another hardly ever.
+type Pick struct {
+	Keyword   string // only the files with this keyword, when not empty
+	Extension string // only the files with this extension, when not empty
+	Random    int64
+}
+
+// Match is whether f is one of the files the Pick is narrowed down to. Files
+// that have expired are never picked, though they may not be removed yet.
+func (p Pick) Match(f types.File) bool {
+	if f.Metadata.IsExpired(time.Now()) {
+		return false
+	}
+	if len(p.Keyword) > 0 && !f.Metadata.HasKeyword(strings.ToLower(p.Keyword)) {
+		return false
+	}
+	if len(p.Extension) > 0 {
+		s := strings.Split(f.Filename, ".")
+		if !strings.EqualFold(s[len(s)-1], p.Extension) {
+			return false
+		}
+	}
+	return true
+}
+
+// File is what is stored and fetched from the backing database.
+// Files opened for reading can Seek, so that they can be served in ranges.
 type File interface {
 	io.Reader
 	io.Writer
+	io.Seeker
 	io.Closer
 	MetaDataer
 }
@@ -68,3 +202,18 @@ type MetaDataer interface {
 	*/
 	SetMeta(metadata interface{})
 }
+
+// Scrubber is optionally implemented by Handlers that store contents apart
+// from the files referring to them, where the two can come apart
+type Scrubber interface {
+	// Orphans lists the ids of the contents that no file refers to, like the
+	// GridFS chunks left behind by an interrupted upload. Uploads still in
+	// progress may be among them.
+	Orphans(ctx context.Context) (ids []string, err error)
+}
+
+// UploadDateSetter is optionally implemented by Files open for writing, to
+// keep the original upload date when copying from another store
+type UploadDateSetter interface {
+	SetUploadDate(t time.Time)
+}
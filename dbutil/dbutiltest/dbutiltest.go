@@ -0,0 +1,1013 @@
+/*
+Package dbutiltest is a conformance suite for dbutil.Handler implementations.
+
+Every backend's tests ought to include something like:
+
+	func TestConformance(t *testing.T) {
+		h := &myHandle{}
+		if err := h.Init(json.Marshal(testConfig)); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		dbutiltest.Run(t, h)
+	}
+*/
+package dbutiltest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/types"
+)
+
+const (
+	blob    = "Hurp til you Derp"
+	blobMd5 = "3ef08fa896a154eee3c97f037c9d6dfc"
+)
+
+// Run exercises h, which must be initialized and empty. Every file the suite
+// creates is removed again before it returns.
+func Run(t *testing.T, h dbutil.Handler) {
+	for _, test := range []struct {
+		name string
+		fn   func(*testing.T, dbutil.Handler)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"Lowercase", testLowercase},
+		{"Md5", testMd5},
+		{"Keywords", testKeywords},
+		{"Extensions", testExtensions},
+		{"Ordering", testOrdering},
+		{"Paging", testPaging},
+		{"Seek", testSeek},
+		{"Shared", testShared},
+		{"SharedRevisions", testSharedRevisions},
+		{"CreateNew", testCreateNew},
+		{"Replace", testReplace},
+		{"Revisions", testRevisions},
+		{"UpdateInfo", testUpdateInfo},
+		{"Rename", testRename},
+		{"Trash", testTrash},
+		{"Expiry", testExpiry},
+		{"Random", testRandom},
+		{"Cancel", testCancel},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, h)
+		})
+	}
+}
+
+// Put stores body as filename, with the given info
+func Put(t *testing.T, h dbutil.Handler, filename string, info types.Info, body string) {
+	t.Helper()
+	ctx := context.Background()
+	f, err := h.Create(ctx, filename)
+	if err != nil {
+		t.Fatalf("Create(%q): %s", filename, err)
+	}
+	f.SetMeta(&info)
+	if _, err := io.WriteString(f, body); err != nil {
+		t.Fatalf("Write(%q): %s", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close(%q): %s", filename, err)
+	}
+}
+
+// Cleanup removes the named files
+func Cleanup(t *testing.T, h dbutil.Handler, filenames ...string) {
+	t.Helper()
+	ctx := context.Background()
+	for _, filename := range filenames {
+		if err := h.Remove(ctx, filename); err != nil {
+			t.Errorf("Remove(%q): %s", filename, err)
+		}
+	}
+}
+
+func testRoundTrip(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	info := types.Info{
+		Keywords:  []string{"cats", "lols"},
+		Ip:        "127.0.0.1:1234",
+		Random:    42,
+		TimeStamp: time.Now().Round(time.Millisecond),
+	}
+	Put(t, h, "roundtrip.gif", info, blob)
+	defer Cleanup(t, h, "roundtrip.gif")
+
+	f, err := h.Open(ctx, "roundtrip.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mInfo types.Info
+	if err := f.GetMeta(&mInfo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != blob {
+		t.Errorf("read %q, expected %q", buf, blob)
+	}
+	if !reflect.DeepEqual(mInfo.Keywords, info.Keywords) || mInfo.Ip != info.Ip ||
+		mInfo.Random != info.Random || !mInfo.TimeStamp.Equal(info.TimeStamp) {
+		t.Errorf("metadata did not round trip! %#v != %#v", mInfo, info)
+	}
+
+	file, err := h.GetFileByFilename(ctx, "roundtrip.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Filename != "roundtrip.gif" || file.Length != uint64(len(blob)) || file.Md5 != blobMd5 {
+		t.Errorf("unexpected file %#v", file)
+	}
+	if file.UploadDate.IsZero() {
+		t.Errorf("UploadDate was not set")
+	}
+
+	if err := h.Remove(ctx, "roundtrip.gif"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := h.HasFileByFilename(ctx, "roundtrip.gif"); err != nil || exists {
+		t.Errorf("HasFileByFilename after Remove: %v, %v", exists, err)
+	}
+	if _, err := h.Open(ctx, "roundtrip.gif"); err == nil {
+		t.Errorf("Open after Remove did not fail")
+	}
+	if _, err := h.GetFileByFilename(ctx, "roundtrip.gif"); err == nil {
+		t.Errorf("GetFileByFilename after Remove did not fail")
+	}
+}
+
+func testLowercase(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	Put(t, h, "MixedCase.PNG", types.Info{TimeStamp: time.Now()}, blob)
+	defer Cleanup(t, h, "MIXEDCASE.png")
+
+	for _, name := range []string{"MixedCase.PNG", "mixedcase.png", "MIXEDCASE.png"} {
+		c, err := h.CountFiles(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 1 {
+			t.Errorf("CountFiles(%q) = %d, expected 1", name, c)
+		}
+		file, err := h.GetFileByFilename(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.Filename != "mixedcase.png" {
+			t.Errorf("GetFileByFilename(%q).Filename = %q, expected it lowercased", name, file.Filename)
+		}
+		f, err := h.Open(ctx, name)
+		if err != nil {
+			t.Fatalf("Open(%q): %s", name, err)
+		}
+		f.Close()
+	}
+}
+
+func testMd5(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	now := time.Now()
+	Put(t, h, "md5-a.txt", types.Info{TimeStamp: now}, blob)
+	Put(t, h, "md5-b.txt", types.Info{TimeStamp: now.Add(time.Second)}, blob)
+	Put(t, h, "md5-c.txt", types.Info{TimeStamp: now}, "something else")
+	defer Cleanup(t, h, "md5-a.txt", "md5-b.txt", "md5-c.txt")
+
+	files, err := h.FindFilesByMd5(ctx, blobMd5, dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := filenames(files); !reflect.DeepEqual(names, []string{"md5-b.txt", "md5-a.txt"}) {
+		t.Errorf("FindFilesByMd5 = %q", names)
+	}
+}
+
+func testKeywords(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	now := time.Now()
+	Put(t, h, "kw-a.jpg", types.Info{Keywords: []string{"cats", "lols"}, TimeStamp: now}, blob)
+	Put(t, h, "kw-b.jpg", types.Info{Keywords: []string{"cats"}, TimeStamp: now.Add(time.Second)}, blob)
+	defer Cleanup(t, h, "kw-a.jpg", "kw-b.jpg")
+
+	files, err := h.FindFilesByKeyword(ctx, "CATS", dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := filenames(files); !reflect.DeepEqual(names, []string{"kw-b.jpg", "kw-a.jpg"}) {
+		t.Errorf("FindFilesByKeyword = %q", names)
+	}
+
+	kp, err := h.GetKeywords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []types.IdCount{
+		{Id: "cats", Value: 2, Root: "k"},
+		{Id: "lols", Value: 1, Root: "k"},
+	}
+	if !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetKeywords = %#v, expected %#v", kp, expected)
+	}
+
+	Cleanup(t, h, "kw-a.jpg")
+	kp, err = h.GetKeywords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []types.IdCount{{Id: "cats", Value: 1, Root: "k"}}
+	if !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetKeywords after Remove = %#v, expected %#v", kp, expected)
+	}
+}
+
+func testExtensions(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	now := time.Now()
+	Put(t, h, "ext-a.gif", types.Info{TimeStamp: now}, blob)
+	Put(t, h, "ext-b.gif", types.Info{TimeStamp: now}, blob)
+	Put(t, h, "ext-c.tar.gz", types.Info{TimeStamp: now}, blob)
+	defer Cleanup(t, h, "ext-a.gif", "ext-b.gif", "ext-c.tar.gz")
+
+	kp, err := h.GetExtensions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []types.IdCount{
+		{Id: "gif", Value: 2, Root: "ext"},
+		{Id: "gz", Value: 1, Root: "ext"},
+	}
+	if !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetExtensions = %#v, expected %#v", kp, expected)
+	}
+
+	files, err := h.FindFilesByPatt(ctx, "GIF$", dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("FindFilesByPatt = %q", filenames(files))
+	}
+}
+
+func testOrdering(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	// uploaded out of order, to be sure it's metadata.timestamp that counts
+	now := time.Now()
+	var names []string
+	for _, i := range []int{3, 1, 4, 0, 2} {
+		name := fmt.Sprintf("order-%d.png", i)
+		Put(t, h, name, types.Info{TimeStamp: now.Add(time.Duration(i) * time.Minute)}, blob)
+		names = append(names, name)
+	}
+	defer Cleanup(t, h, names...)
+
+	files, err := h.GetFiles(ctx, dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"order-4.png", "order-3.png", "order-2.png", "order-1.png", "order-0.png"}
+	if names := filenames(files); !reflect.DeepEqual(names, expected) {
+		t.Errorf("GetFiles = %q, expected %q", names, expected)
+	}
+
+	files, err = h.GetFiles(ctx, dbutil.Page{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := filenames(files); !reflect.DeepEqual(names, expected[:2]) {
+		t.Errorf("GetFiles(Limit 2) = %q, expected %q", names, expected[:2])
+	}
+}
+
+func testPaging(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	var names []string
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("page-%d.png", i)
+		Put(t, h, name, types.Info{Keywords: []string{"paged"}, TimeStamp: now.Add(time.Duration(i) * time.Minute)}, blob)
+		names = append(names, name)
+	}
+	defer Cleanup(t, h, names...)
+
+	for _, test := range []struct {
+		page     dbutil.Page
+		expected []string
+	}{
+		{dbutil.Page{Limit: 2}, []string{"page-4.png", "page-3.png"}},
+		{dbutil.Page{Limit: 2, Offset: 2}, []string{"page-2.png", "page-1.png"}},
+		{dbutil.Page{Limit: 2, Offset: 4}, []string{"page-0.png"}},
+		{dbutil.Page{Limit: 2, Offset: 6}, nil},
+		{dbutil.Page{Before: now.Add(3 * time.Minute)}, []string{"page-2.png", "page-1.png", "page-0.png"}},
+		{dbutil.Page{Limit: 1, Offset: 1, Before: now.Add(3 * time.Minute)}, []string{"page-1.png"}},
+	} {
+		files, err := h.GetFiles(ctx, test.page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := filenames(files); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("GetFiles(%+v) = %q, expected %q", test.page, names, test.expected)
+		}
+		files, err = h.FindFilesByKeyword(ctx, "paged", test.page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := filenames(files); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("FindFilesByKeyword(%+v) = %q, expected %q", test.page, names, test.expected)
+		}
+	}
+}
+
+// of two CreateNews of the same name, only the first is stored
+func testCreateNew(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	Put(t, h, "taken.gif", types.Info{TimeStamp: time.Now()}, blob)
+	defer Cleanup(t, h, "taken.gif", "new.gif")
+
+	if _, err := h.CreateNew(ctx, "TAKEN.gif"); err != dbutil.ErrExists {
+		t.Errorf("CreateNew of a stored name = %v, expected %v", err, dbutil.ErrExists)
+	}
+
+	first, err := h.CreateNew(ctx, "new.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := h.CreateNew(ctx, "new.gif")
+	if err == nil {
+		// the handler can only tell at Close
+		io.WriteString(second, "second")
+	} else if err != dbutil.ErrExists {
+		t.Fatalf("second CreateNew = %v, expected %v", err, dbutil.ErrExists)
+	}
+	io.WriteString(first, blob)
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close of the first CreateNew: %s", err)
+	}
+	if second != nil {
+		if err := second.Close(); err != dbutil.ErrExists {
+			t.Errorf("Close of the second CreateNew = %v, expected %v", err, dbutil.ErrExists)
+		}
+	}
+
+	if c, err := h.CountFiles(ctx, "new.gif"); err != nil {
+		t.Fatal(err)
+	} else if c != 1 {
+		t.Errorf("CountFiles = %d, expected 1", c)
+	}
+
+	// and once it is stored, the name is no longer held
+	Cleanup(t, h, "new.gif")
+	f, err := h.CreateNew(ctx, "new.gif")
+	if err != nil {
+		t.Fatalf("CreateNew after Remove: %s", err)
+	}
+	io.WriteString(f, blob)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testReplace(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	Put(t, h, "replace.gif", types.Info{Keywords: []string{"before"}, TimeStamp: time.Now()}, blob)
+	defer Cleanup(t, h, "replace.gif")
+
+	f, err := h.Replace(ctx, "REPLACE.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetMeta(&types.Info{Keywords: []string{"after"}, TimeStamp: time.Now()})
+	io.WriteString(f, "replaced")
+	if body := get(t, h, "replace.gif"); body != blob {
+		t.Errorf("before Close, got %q, expected %q", body, blob)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(t, h, "replace.gif"); body != "replaced" {
+		t.Errorf("after Close, got %q, expected %q", body, "replaced")
+	}
+
+	if c, err := h.CountFiles(ctx, "replace.gif"); err != nil {
+		t.Fatal(err)
+	} else if c != 1 {
+		t.Errorf("CountFiles = %d, expected 1", c)
+	}
+	kp, err := h.GetKeywords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []types.IdCount{{Id: "after", Value: 1, Root: "k"}}
+	if !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetKeywords = %#v, expected %#v", kp, expected)
+	}
+}
+
+func testRevisions(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	Put(t, h, "diagram.png", types.Info{Keywords: []string{"v1"}, Ip: "127.0.0.1:1234", TimeStamp: time.Now()}, blob)
+
+	f, err := h.CreateRevision(ctx, "Diagram.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetMeta(&types.Info{Keywords: []string{"v2"}, Ip: "127.0.0.2:1234", TimeStamp: time.Now()})
+	io.WriteString(f, "revised")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := get(t, h, "diagram.png"); body != "revised" {
+		t.Errorf("got %q, expected %q", body, "revised")
+	}
+	revs, err := h.GetRevisions(ctx, "diagram.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 {
+		t.Fatalf("GetRevisions = %d revisions, expected 2", len(revs))
+	}
+	if revs[0].Md5 != blobMd5 || !revs[0].Metadata.IsSuperseded() || revs[0].Metadata.Ip != "127.0.0.1:1234" {
+		t.Errorf("first revision = %#v", revs[0])
+	}
+	if revs[1].Length != uint64(len("revised")) || revs[1].Metadata.IsSuperseded() {
+		t.Errorf("second revision = %#v", revs[1])
+	}
+	rf, err := h.OpenRevision(ctx, "diagram.png", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(rf)
+	rf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != blob {
+		t.Errorf("revision 1 = %q, expected %q", buf, blob)
+	}
+	for _, n := range []int{0, 3} {
+		if _, err := h.OpenRevision(ctx, "diagram.png", n); err != dbutil.ErrNotFound {
+			t.Errorf("OpenRevision(%d) = %v, expected %v", n, err, dbutil.ErrNotFound)
+		}
+	}
+
+	files, err := h.GetFiles(ctx, dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Md5 == blobMd5 {
+		t.Errorf("GetFiles = %#v, expected only the current revision", files)
+	}
+	if files, err = h.FindFilesByPatt(ctx, `\.png$`, dbutil.Page{}); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 || files[0].Md5 == blobMd5 {
+		t.Errorf("FindFilesByPatt = %#v, expected only the current revision", files)
+	}
+	if err := h.AddKeywords(ctx, "diagram.png", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	kp, err := h.GetKeywords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []types.IdCount{{Id: "latest", Value: 1, Root: "k"}, {Id: "v2", Value: 1, Root: "k"}}
+	if !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetKeywords = %#v, expected %#v", kp, expected)
+	}
+	if revs, err = h.GetRevisions(ctx, "diagram.png"); err != nil {
+		t.Fatal(err)
+	} else if len(revs) != 2 || !revs[0].Metadata.Modified.IsZero() || revs[1].Metadata.Modified.IsZero() {
+		t.Errorf("GetRevisions after AddKeywords = %#v, expected only the current revision modified", revs)
+	}
+
+	if err := h.Rename(ctx, "diagram.png", "chart.png"); err != nil {
+		t.Fatal(err)
+	}
+	if revs, err = h.GetRevisions(ctx, "chart.png"); err != nil {
+		t.Fatal(err)
+	} else if len(revs) != 2 || !reflect.DeepEqual(revs[0].Metadata.Keywords, []string{"v1"}) {
+		t.Errorf("GetRevisions after the rename = %#v", revs)
+	}
+
+	if err := h.RemoveRevision(ctx, "chart.png", 3); err != dbutil.ErrNotFound {
+		t.Errorf("RemoveRevision(3) = %v, expected %v", err, dbutil.ErrNotFound)
+	}
+	if err := h.RemoveRevision(ctx, "chart.png", 2); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(t, h, "chart.png"); body != blob {
+		t.Errorf("got %q after removing the current revision, expected %q", body, blob)
+	}
+	if revs, err = h.GetRevisions(ctx, "chart.png"); err != nil {
+		t.Fatal(err)
+	} else if len(revs) != 1 || revs[0].Metadata.IsSuperseded() {
+		t.Errorf("GetRevisions after RemoveRevision = %#v", revs)
+	}
+	if files, err = h.GetFiles(ctx, dbutil.Page{}); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 || files[0].Md5 != blobMd5 {
+		t.Errorf("GetFiles after RemoveRevision = %#v, expected the first revision", files)
+	}
+	if kp, err = h.GetKeywords(ctx); err != nil {
+		t.Fatal(err)
+	} else if expected := []types.IdCount{{Id: "v1", Value: 1, Root: "k"}}; !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetKeywords after RemoveRevision = %#v, expected %#v", kp, expected)
+	}
+
+	Cleanup(t, h, "chart.png")
+	if _, err := h.GetRevisions(ctx, "chart.png"); err != dbutil.ErrNotFound {
+		t.Errorf("GetRevisions after Remove = %v, expected %v", err, dbutil.ErrNotFound)
+	}
+}
+
+func testUpdateInfo(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	Put(t, h, "meta.gif", types.Info{Keywords: []string{"a", "b"}, Ip: "127.0.0.1:1234", TimeStamp: time.Now()}, blob)
+	defer Cleanup(t, h, "meta.gif")
+
+	if err := h.AddKeywords(ctx, "META.gif", "c", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.RemoveKeywords(ctx, "meta.gif", "b"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := h.GetFileByFilename(ctx, "meta.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "c"}; !reflect.DeepEqual(f.Metadata.Keywords, expected) {
+		t.Errorf("Keywords = %q, expected %q", f.Metadata.Keywords, expected)
+	}
+	if f.Metadata.Modified.IsZero() {
+		t.Errorf("Modified was not set")
+	}
+	if f.Md5 != blobMd5 {
+		t.Errorf("Md5 = %q, expected %q", f.Md5, blobMd5)
+	}
+	kp, err := h.GetKeywords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []types.IdCount{{Id: "a", Value: 1, Root: "k"}, {Id: "c", Value: 1, Root: "k"}}
+	if !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetKeywords = %#v, expected %#v", kp, expected)
+	}
+
+	info := f.Metadata
+	info.Ip = "127.0.0.2:1234"
+	if err := h.UpdateInfo(ctx, "meta.gif", info); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = h.GetFileByFilename(ctx, "meta.gif"); err != nil {
+		t.Fatal(err)
+	} else if f.Metadata.Ip != info.Ip {
+		t.Errorf("Ip = %q, expected %q", f.Metadata.Ip, info.Ip)
+	}
+	if body := get(t, h, "meta.gif"); body != blob {
+		t.Errorf("got %q, expected %q", body, blob)
+	}
+
+	if err := h.AddKeywords(ctx, "missing.gif", "a"); err != dbutil.ErrNotFound {
+		t.Errorf("AddKeywords of a missing file = %v, expected %v", err, dbutil.ErrNotFound)
+	}
+}
+
+func testRename(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	uploaded := time.Now().Round(time.Millisecond)
+	Put(t, h, "before.gif", types.Info{Keywords: []string{"a"}, TimeStamp: uploaded}, blob)
+	Put(t, h, "taken.png", types.Info{TimeStamp: uploaded}, blob+blob)
+	defer Cleanup(t, h, "taken.png")
+
+	if err := h.Rename(ctx, "before.gif", "taken.png"); err != dbutil.ErrExists {
+		t.Errorf("Rename onto a taken name = %v, expected %v", err, dbutil.ErrExists)
+	}
+	if err := h.Rename(ctx, "missing.gif", "after.png"); err != dbutil.ErrNotFound {
+		t.Errorf("Rename of a missing file = %v, expected %v", err, dbutil.ErrNotFound)
+	}
+	if err := h.Rename(ctx, "BEFORE.gif", "After.png"); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup(t, h, "after.png")
+
+	if exists, err := h.HasFileByFilename(ctx, "before.gif"); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Errorf("before.gif is still there after the rename")
+	}
+	if body := get(t, h, "after.png"); body != blob {
+		t.Errorf("got %q, expected %q", body, blob)
+	}
+	f, err := h.GetFileByFilename(ctx, "after.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.Metadata.Keywords, []string{"a"}) || !f.Metadata.TimeStamp.Equal(uploaded) {
+		t.Errorf("metadata was not kept: %#v", f.Metadata)
+	}
+	if f, err = h.GetFileByFormerName(ctx, "Before.gif"); err != nil {
+		t.Fatal(err)
+	} else if f.Filename != "after.png" {
+		t.Errorf("GetFileByFormerName = %q, expected %q", f.Filename, "after.png")
+	}
+	if _, err := h.GetFileByFormerName(ctx, "after.png"); err != dbutil.ErrNotFound {
+		t.Errorf("GetFileByFormerName of the current name = %v, expected %v", err, dbutil.ErrNotFound)
+	}
+
+	kp, err := h.GetExtensions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []types.IdCount{{Id: "png", Value: 2, Root: "ext"}}
+	if !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetExtensions = %#v, expected %#v", kp, expected)
+	}
+}
+
+func testTrash(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	now := time.Now()
+	Put(t, h, "kept.gif", types.Info{Keywords: []string{"a"}, TimeStamp: now}, blob)
+	Put(t, h, "trashed.png", types.Info{Keywords: []string{"a", "b"}, TimeStamp: now.Add(time.Second)}, blob)
+	defer Cleanup(t, h, "kept.gif", "trashed.png")
+
+	f, err := h.GetFileByFilename(ctx, "trashed.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := f.Metadata
+	info.Trash("127.0.0.1:1234", now.Round(time.Millisecond))
+	if err := h.UpdateInfo(ctx, "trashed.png", info); err != nil {
+		t.Fatal(err)
+	}
+
+	listings := map[string]func() ([]types.File, error){
+		"GetFiles":           func() ([]types.File, error) { return h.GetFiles(ctx, dbutil.Page{}) },
+		"FindFilesByKeyword": func() ([]types.File, error) { return h.FindFilesByKeyword(ctx, "a", dbutil.Page{}) },
+		"FindFilesByMd5":     func() ([]types.File, error) { return h.FindFilesByMd5(ctx, blobMd5, dbutil.Page{}) },
+		"FindFilesByPatt":    func() ([]types.File, error) { return h.FindFilesByPatt(ctx, "e", dbutil.Page{}) },
+	}
+	for name, list := range listings {
+		files, err := list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := filenames(files); !reflect.DeepEqual(names, []string{"kept.gif"}) {
+			t.Errorf("%s with trashed.png in the trash = %q", name, names)
+		}
+	}
+	kp, err := h.GetKeywords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []types.IdCount{{Id: "a", Value: 1, Root: "k"}}; !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetKeywords = %#v, expected %#v", kp, expected)
+	}
+	kp, err = h.GetExtensions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []types.IdCount{{Id: "gif", Value: 1, Root: "ext"}}; !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetExtensions = %#v, expected %#v", kp, expected)
+	}
+
+	trash, err := h.GetTrash(ctx, dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := filenames(trash); !reflect.DeepEqual(names, []string{"trashed.png"}) {
+		t.Fatalf("GetTrash = %q", names)
+	}
+	if !trash[0].Metadata.Deleted.Equal(info.Deleted) || trash[0].Metadata.DeletedBy != info.DeletedBy {
+		t.Errorf("trashed metadata = %#v, expected %#v", trash[0].Metadata, info)
+	}
+	if f, err := h.GetFileByFilename(ctx, "trashed.png"); err != nil {
+		t.Errorf("GetFileByFilename of the trash: %s", err)
+	} else if !f.Metadata.IsDeleted() {
+		t.Errorf("GetFileByFilename of the trash is not deleted")
+	}
+
+	info.Restore()
+	if err := h.UpdateInfo(ctx, "trashed.png", info); err != nil {
+		t.Fatal(err)
+	}
+	files, err := h.FindFilesByKeyword(ctx, "a", dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := filenames(files); !reflect.DeepEqual(names, []string{"trashed.png", "kept.gif"}) {
+		t.Errorf("FindFilesByKeyword after the restore = %q", names)
+	}
+	if trash, err = h.GetTrash(ctx, dbutil.Page{}); err != nil {
+		t.Fatal(err)
+	} else if len(trash) != 0 {
+		t.Errorf("GetTrash after the restore = %q", filenames(trash))
+	}
+	kp, err = h.GetKeywords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []types.IdCount{{Id: "a", Value: 2, Root: "k"}, {Id: "b", Value: 1, Root: "k"}}; !reflect.DeepEqual(kp, expected) {
+		t.Errorf("GetKeywords after the restore = %#v, expected %#v", kp, expected)
+	}
+}
+
+func testExpiry(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	now := time.Now().Round(time.Millisecond)
+	expired := types.Info{TimeStamp: now}
+	expired.ExpireIn(-time.Minute, now)
+	later := types.Info{TimeStamp: now}
+	later.ExpireIn(time.Hour, now)
+	trashed := expired
+	trashed.Trash("127.0.0.1:1234", now)
+	Put(t, h, "expired.png", expired, blob)
+	Put(t, h, "later.png", later, blob)
+	Put(t, h, "kept.png", types.Info{TimeStamp: now}, blob)
+	Put(t, h, "trashed.png", trashed, blob)
+	defer Cleanup(t, h, "expired.png", "later.png", "kept.png", "trashed.png")
+
+	// only the current revision's expiry counts
+	Put(t, h, "revised.png", expired, blob)
+	defer Cleanup(t, h, "revised.png")
+	f, err := h.CreateRevision(ctx, "revised.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetMeta(&types.Info{TimeStamp: now})
+	io.WriteString(f, "revised")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := h.GetExpired(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := filenames(files)
+	sort.Strings(names)
+	if expected := []string{"expired.png", "trashed.png"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("GetExpired = %q, expected %q", names, expected)
+	}
+	if len(files) > 0 && !files[0].Metadata.Expires.Equal(expired.Expires) {
+		t.Errorf("expires = %s, expected %s", files[0].Metadata.Expires, expired.Expires)
+	}
+	if files, err = h.GetExpired(ctx, now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 3 {
+		t.Errorf("GetExpired in two hours = %q", filenames(files))
+	}
+}
+
+// GetRandomFile picks by Metadata.Random, wrapping around, and leaves out the
+// trash and earlier revisions
+func testRandom(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	now := time.Now()
+	trashed := types.Info{Keywords: []string{"cats"}, Random: 40, TimeStamp: now}
+	trashed.Trash("127.0.0.1:1234", now)
+	Put(t, h, "random-a.png", types.Info{Keywords: []string{"cats"}, Random: 10, TimeStamp: now}, blob)
+	Put(t, h, "random-b.gif", types.Info{Keywords: []string{"cats"}, Random: 20, TimeStamp: now}, blob)
+	Put(t, h, "random-c.png", types.Info{Keywords: []string{"dogs"}, Random: 30, TimeStamp: now}, blob)
+	Put(t, h, "random-d.png", trashed, blob)
+	Put(t, h, "random-e.jpg", types.Info{Random: 50, TimeStamp: now}, blob)
+	// expired, but not removed yet
+	Put(t, h, "random-f.png", types.Info{Keywords: []string{"cats"}, Random: 11, TimeStamp: now, Expires: now.Add(-time.Minute)}, blob)
+	defer Cleanup(t, h, "random-a.png", "random-b.gif", "random-c.png", "random-d.png", "random-e.jpg", "random-f.png")
+	f, err := h.CreateRevision(ctx, "random-e.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetMeta(&types.Info{Random: 12, TimeStamp: now})
+	io.WriteString(f, "revised")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		pick     dbutil.Pick
+		expected string
+	}{
+		{dbutil.Pick{Random: 11}, "random-e.jpg"},
+		{dbutil.Pick{Random: 20}, "random-b.gif"},
+		{dbutil.Pick{Random: 25}, "random-c.png"},
+		{dbutil.Pick{Random: 35}, "random-a.png"},
+		{dbutil.Pick{Keyword: "cats", Random: 11}, "random-b.gif"},
+		{dbutil.Pick{Keyword: "CATS", Random: 25}, "random-a.png"},
+		{dbutil.Pick{Extension: "png", Random: 11}, "random-c.png"},
+		{dbutil.Pick{Keyword: "cats", Extension: "png", Random: 11}, "random-a.png"},
+	} {
+		f, err := h.GetRandomFile(ctx, c.pick)
+		if err != nil {
+			t.Errorf("GetRandomFile(%+v): %s", c.pick, err)
+		} else if f.Filename != c.expected {
+			t.Errorf("GetRandomFile(%+v) = %q, expected %q", c.pick, f.Filename, c.expected)
+		}
+	}
+	if _, err := h.GetRandomFile(ctx, dbutil.Pick{Keyword: "random-none"}); err != dbutil.ErrNotFound {
+		t.Errorf("GetRandomFile of no files: err = %v, expected %v", err, dbutil.ErrNotFound)
+	}
+}
+
+// get reads back the contents of filename
+func get(t *testing.T, h dbutil.Handler, filename string) string {
+	t.Helper()
+	f, err := h.Open(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("Open(%q): %s", filename, err)
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read(%q): %s", filename, err)
+	}
+	return string(buf)
+}
+
+// handlers may store identical contents only once, but each name still has
+// to come and go independently
+func testShared(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	Put(t, h, "shared-a.gif", types.Info{Keywords: []string{"a"}, TimeStamp: time.Now()}, blob)
+	Put(t, h, "shared-b.gif", types.Info{Keywords: []string{"b"}, TimeStamp: time.Now()}, blob)
+	defer Cleanup(t, h, "shared-b.gif")
+
+	readShared(t, h, "shared-b.gif", "b")
+	Cleanup(t, h, "shared-a.gif")
+	readShared(t, h, "shared-b.gif", "b")
+	if f, err := h.GetFileByFilename(ctx, "shared-b.gif"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(f.Metadata.Keywords, []string{"b"}) {
+		t.Errorf("GetFileByFilename after removing its twin = %#v", f)
+	}
+}
+
+func testSharedRevisions(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	Put(t, h, "twice.gif", types.Info{Keywords: []string{"a"}, TimeStamp: time.Now()}, blob)
+	f, err := h.CreateRevision(ctx, "twice.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetMeta(&types.Info{Keywords: []string{"b"}, TimeStamp: time.Now()})
+	io.WriteString(f, blob)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	readShared(t, h, "twice.gif", "b")
+
+	Cleanup(t, h, "twice.gif")
+	if exists, err := h.HasFileByFilename(ctx, "twice.gif"); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Errorf("HasFileByFilename after Remove = true, expected false")
+	}
+	if kp, err := h.GetKeywords(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(kp) > 0 {
+		t.Errorf("GetKeywords after Remove = %#v, expected none", kp)
+	}
+	if s, ok := h.(dbutil.Scrubber); ok {
+		if ids, err := s.Orphans(ctx); err != nil {
+			t.Fatal(err)
+		} else if len(ids) > 0 {
+			t.Errorf("Orphans after Remove = %q, expected none", ids)
+		}
+	}
+}
+
+// readShared checks that filename reads as blob, with its own keyword
+func readShared(t *testing.T, h dbutil.Handler, filename, keyword string) {
+	t.Helper()
+	f, err := h.Open(context.Background(), filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != blob {
+		t.Errorf("read %q from %s, expected %q", buf, filename, blob)
+	}
+	var info types.Info
+	if err := f.GetMeta(&info); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info.Keywords, []string{keyword}) {
+		t.Errorf("%s has keywords %q, expected %q", filename, info.Keywords, keyword)
+	}
+}
+
+func testSeek(t *testing.T, h dbutil.Handler) {
+	ctx := context.Background()
+	Put(t, h, "seek.webm", types.Info{TimeStamp: time.Now()}, blob)
+	defer Cleanup(t, h, "seek.webm")
+
+	f, err := h.Open(ctx, "seek.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, seek := range []struct {
+		offset   int64
+		whence   int
+		pos      int64
+		expected string
+	}{
+		{-4, io.SeekEnd, int64(len(blob)) - 4, "Derp"},
+		{5, io.SeekStart, 5, "til "},
+		{-9, io.SeekCurrent, 0, "Hurp"},
+		{9, io.SeekCurrent, 13, "Derp"},
+		{0, io.SeekEnd, int64(len(blob)), ""},
+		{0, io.SeekStart, 0, blob},
+	} {
+		pos, err := f.Seek(seek.offset, seek.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d): %s", seek.offset, seek.whence, err)
+		}
+		if pos != seek.pos {
+			t.Errorf("Seek(%d, %d) = %d, expected %d", seek.offset, seek.whence, pos, seek.pos)
+		}
+		buf := make([]byte, len(seek.expected))
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatalf("Read after Seek(%d, %d): %s", seek.offset, seek.whence, err)
+		}
+		if string(buf) != seek.expected {
+			t.Errorf("Read after Seek(%d, %d) = %q, expected %q", seek.offset, seek.whence, buf, seek.expected)
+		}
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end = %d, %v, expected io.EOF", n, err)
+	}
+}
+
+func testCancel(t *testing.T, h dbutil.Handler) {
+	Put(t, h, "cancel.gif", types.Info{TimeStamp: time.Now()}, blob)
+	defer Cleanup(t, h, "cancel.gif")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f, err := h.Open(ctx, "cancel.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := ioutil.ReadAll(f); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read after cancel = %v, expected %v", err, context.Canceled)
+	}
+	f.Close()
+	if _, err := h.Open(ctx, "cancel.gif"); err == nil {
+		t.Errorf("Open with a cancelled context did not fail")
+	}
+	if _, err := h.GetFiles(ctx, dbutil.Page{}); err == nil {
+		t.Errorf("GetFiles with a cancelled context did not fail")
+	}
+
+	// an upload cancelled part way through is not kept
+	ctx, cancel = context.WithCancel(context.Background())
+	f, err = h.Create(ctx, "cancelled.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetMeta(&types.Info{TimeStamp: time.Now()})
+	if _, err := io.WriteString(f, blob); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := io.WriteString(f, blob); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write after cancel = %v, expected %v", err, context.Canceled)
+	}
+	if err := f.Close(); err == nil {
+		t.Errorf("Close after cancel did not fail")
+	}
+	if exists, err := h.HasFileByFilename(context.Background(), "cancelled.gif"); err != nil || exists {
+		t.Errorf("HasFileByFilename after a cancelled upload: %v, %v", exists, err)
+	}
+}
+
+func filenames(files []types.File) (names []string) {
+	for _, f := range files {
+		names = append(names, f.Filename)
+	}
+	return names
+}
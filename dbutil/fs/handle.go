@@ -0,0 +1,131 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/dbutil/blobstore"
+)
+
+func init() {
+	dbutil.Handles["fs"] = &fsHandle{}
+}
+
+const (
+	indexName = "index.json" // sidecar metadata for all the stored files
+	blobsDir  = "blobs"      // file bodies, named by their entry Id
+	tmpDir    = "tmp"        // in-progress uploads
+)
+
+type dbConfig struct {
+	Dir string // directory to store the files and index in
+}
+
+type fsHandle struct {
+	blobstore.Handle
+	config dbConfig
+}
+
+func (h *fsHandle) Init(config []byte, err error) error {
+	if err != nil {
+		return err
+	}
+
+	h.config = dbConfig{}
+	if err := json.Unmarshal(config, &h.config); err != nil {
+		return err
+	}
+	if len(h.config.Dir) == 0 {
+		return errors.New("fs: no data directory provided")
+	}
+
+	for _, dir := range []string{blobsDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(h.config.Dir, dir), 0755); err != nil {
+			return err
+		}
+	}
+	h.TempDir = filepath.Join(h.config.Dir, tmpDir)
+	return h.Setup(dirBackend(h.config.Dir))
+}
+
+// dirBackend keeps the blobs as plain files, in a directory on disk
+type dirBackend string
+
+func (d dirBackend) blobPath(id string) string {
+	return filepath.Join(string(d), blobsDir, id)
+}
+
+func (d dirBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// uploads are spooled into our own tmp directory, so just move them into place
+	if f, ok := r.(*os.File); ok && filepath.Dir(f.Name()) == filepath.Join(string(d), tmpDir) {
+		return os.Rename(f.Name(), d.blobPath(id))
+	}
+
+	fh, err := os.Create(d.blobPath(id))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, r); err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return err
+	}
+	return fh.Close()
+}
+
+func (d dirBackend) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	return os.Open(d.blobPath(id))
+}
+
+func (d dirBackend) Delete(ctx context.Context, id string) error {
+	if err := os.Remove(d.blobPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d dirBackend) List(ctx context.Context) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(string(d), blobsDir))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(infos))
+	for i, fi := range infos {
+		ids[i] = fi.Name()
+	}
+	return ids, nil
+}
+
+func (d dirBackend) LoadIndex() ([]byte, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(string(d), indexName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return buf, err
+}
+
+func (d dirBackend) SaveIndex(buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Join(string(d), tmpDir), indexName)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(string(d), indexName))
+}
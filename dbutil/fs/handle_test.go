@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/dbutil/dbutiltest"
+	"github.com/vbatts/imgsrv/types"
+)
+
+func newTestHandle(t *testing.T, dir string) *fsHandle {
+	h := &fsHandle{}
+	if err := h.Init(json.Marshal(dbConfig{Dir: dir})); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "imgsrv-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := newTestHandle(t, dir)
+	for i, name := range []string{"Cat.GIF", "dog.png"} {
+		f, err := h.Create(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.SetMeta(&types.Info{
+			Keywords:  []string{"pets", strings.Split(strings.ToLower(name), ".")[0]},
+			TimeStamp: time.Now().Add(time.Duration(i) * time.Second),
+		})
+		if _, err := io.WriteString(f, "Hurp til you Derp"); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reload the index from disk
+	h = newTestHandle(t, dir)
+
+	file, err := h.GetFileByFilename(ctx, "CAT.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Filename != "cat.gif" {
+		t.Errorf("expected lowercase filename, got %q", file.Filename)
+	}
+	if expected := "3ef08fa896a154eee3c97f037c9d6dfc"; file.Md5 != expected {
+		t.Errorf("md5 did not match! %s != %s", file.Md5, expected)
+	}
+
+	f, err := h.Open(ctx, "cat.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "Hurp til you Derp" {
+		t.Errorf("unexpected contents %q", buf)
+	}
+
+	files, err := h.GetFiles(ctx, dbutil.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Filename != "dog.png" {
+		t.Errorf("expected newest first, got %#v", files)
+	}
+
+	kw, err := h.GetKeywords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kw) != 3 || kw[2].Id != "pets" || kw[2].Value != 2 || kw[2].Root != "k" {
+		t.Errorf("unexpected keyword counts %#v", kw)
+	}
+
+	if err := h.Remove(ctx, "cat.gif"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := h.HasFileByFilename(ctx, "cat.gif"); exists {
+		t.Errorf("cat.gif still exists after Remove")
+	}
+
+	// both had the same contents, so they shared the one blob until now
+	blobs, err := ioutil.ReadDir(filepath.Join(dir, blobsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 {
+		t.Errorf("expected dog.png to still have its blob, found %d", len(blobs))
+	}
+	if err := h.Remove(ctx, "dog.png"); err != nil {
+		t.Fatal(err)
+	}
+	if blobs, _ = ioutil.ReadDir(filepath.Join(dir, blobsDir)); len(blobs) != 0 {
+		t.Errorf("expected the blob to be deleted with its last name, found %d", len(blobs))
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imgsrv-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbutiltest.Run(t, newTestHandle(t, dir))
+}
+
+func TestOrphans(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "imgsrv-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := newTestHandle(t, dir)
+	dbutiltest.Put(t, h, "kept.gif", types.Info{TimeStamp: time.Now()}, "Hurp til you Derp")
+	// a blob stored by an upload that never made it into the index
+	if err := ioutil.WriteFile(filepath.Join(dir, blobsDir, "lost"), []byte("lost"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := h.Orphans(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "lost" {
+		t.Errorf("Orphans = %q, expected only %q", ids, "lost")
+	}
+}
@@ -0,0 +1,92 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/dbutil/blobstore"
+)
+
+func init() {
+	dbutil.Handles["memory"] = &memoryHandle{}
+}
+
+// memoryHandle keeps everything in memory, and forgets it all on exit.
+// It is for tests and trying imgsrv out.
+type memoryHandle struct {
+	blobstore.Handle
+}
+
+func (h *memoryHandle) Init(config []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	return h.Setup(&mapBackend{blobs: map[string][]byte{}})
+}
+
+type mapBackend struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func (m *mapBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[id] = buf
+	return nil
+}
+
+func (m *mapBackend) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	buf, ok := m.blobs[id]
+	if !ok {
+		return nil, dbutil.ErrNotFound
+	}
+	return blob{bytes.NewReader(buf)}, nil
+}
+
+// blob is a stored buffer, that can be Seeked
+type blob struct {
+	*bytes.Reader
+}
+
+func (b blob) Close() error {
+	return nil
+}
+
+func (m *mapBackend) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, id)
+	return nil
+}
+
+func (m *mapBackend) List(ctx context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.blobs))
+	for id := range m.blobs {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// the blobstore.Handle already holds the index in memory, so there is
+// nothing more to load or save
+
+func (m *mapBackend) LoadIndex() ([]byte, error) {
+	return nil, nil
+}
+
+func (m *mapBackend) SaveIndex(buf []byte) error {
+	return nil
+}
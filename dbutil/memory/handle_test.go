@@ -0,0 +1,16 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/vbatts/imgsrv/dbutil/dbutiltest"
+)
+
+func TestConformance(t *testing.T) {
+	h := &memoryHandle{}
+	if err := h.Init(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	dbutiltest.Run(t, h)
+}
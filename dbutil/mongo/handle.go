@@ -1,8 +1,13 @@
 package mongo
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/vbatts/imgsrv/dbutil"
 	"github.com/vbatts/imgsrv/types"
@@ -23,6 +28,8 @@ type dbConfig struct {
 	DbName string // mongo database name, if needed
 }
 
+// mongoHandle stores files in GridFS. Uploads of the same contents share the
+// chunks of the first of them, as recorded in fs.blobs, and drop their own.
 type mongoHandle struct {
 	config  dbConfig
 	Session *mgo.Session
@@ -58,7 +65,10 @@ func (h *mongoHandle) Init(config []byte, err error) error {
 		}
 	}
 	h.Gfs = h.FileDb.GridFS("fs")
-	return nil
+	if err := ensureIndexes(h.Gfs.Files); err != nil {
+		return err
+	}
+	return initCounts(h.FileDb, h.Gfs)
 }
 
 func (h mongoHandle) Close() error {
@@ -66,76 +76,534 @@ func (h mongoHandle) Close() error {
 	return nil
 }
 
+// session copies h.Session for a single call, which will give up at the ctx
+// deadline, if there is one. mgo can not abandon an operation in flight, so a
+// cancelled ctx is only noticed before each one.
+func (h mongoHandle) session(ctx context.Context) (*mgo.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := h.Session.Copy()
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			s.Close()
+			return nil, context.DeadlineExceeded
+		}
+		s.SetSocketTimeout(timeout)
+	}
+	return s, nil
+}
+
+// with runs fn against the GridFS, on a session for ctx
+func (h mongoHandle) with(ctx context.Context, fn func(gfs *mgo.GridFS) error) error {
+	s, err := h.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return fn(s.DB(h.FileDb.Name).GridFS("fs"))
+}
+
 // pass through for GridFs
-func (h mongoHandle) Open(filename string) (file dbutil.File, err error) {
-	return h.Gfs.Open(strings.ToLower(filename))
+func (h mongoHandle) Open(ctx context.Context, filename string) (file dbutil.File, err error) {
+	s, err := h.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gfs := s.DB(h.FileDb.Name).GridFS("fs")
+	var doc revision
+	err = gfs.Find(bson.M{"filename": strings.ToLower(filename)}).Sort("-uploadDate").One(&doc)
+	if err == mgo.ErrNotFound {
+		s.Close()
+		return nil, dbutil.ErrNotFound
+	} else if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return openFile(ctx, s, gfs, doc)
+}
+
+// openFile opens the file document doc on s, reading the chunks of the file
+// it shares them with, if it does. s is closed along with the file.
+func openFile(ctx context.Context, s *mgo.Session, gfs *mgo.GridFS, doc revision) (dbutil.File, error) {
+	id := doc.Id
+	if doc.Blob != nil {
+		id = doc.Blob
+	}
+	f, err := gfs.OpenId(id)
+	if err == mgo.ErrNotFound {
+		s.Close()
+		return nil, dbutil.ErrNotFound
+	} else if err != nil {
+		s.Close()
+		return nil, err
+	}
+	file := &gridFile{GridFile: f, ctx: ctx, session: s, gfs: gfs}
+	if doc.Blob != nil {
+		file.info = &doc.Metadata
+	}
+	return file, nil
 }
 
 // pass through for GridFs
-func (h mongoHandle) Create(filename string) (file dbutil.File, err error) {
-	return h.Gfs.Create(strings.ToLower(filename))
+func (h mongoHandle) Create(ctx context.Context, filename string) (file dbutil.File, err error) {
+	s, err := h.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gfs := s.DB(h.FileDb.Name).GridFS("fs")
+	f, err := gfs.Create(strings.ToLower(filename))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &gridFile{GridFile: f, ctx: ctx, session: s, gfs: gfs, writing: true}, nil
+}
+
+// CreateNew relies on the unique index on filename, which fails the insert of
+// a second file of the same name, once its chunks are written. Without the
+// index, only the check up front is done.
+func (h mongoHandle) CreateNew(ctx context.Context, filename string) (file dbutil.File, err error) {
+	if exists, err := h.HasFileByFilename(ctx, filename); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, dbutil.ErrExists
+	}
+	return h.Create(ctx, filename)
 }
 
 // pass through for GridFs
-func (h mongoHandle) Remove(filename string) (err error) {
-	return h.Gfs.Remove(strings.ToLower(filename))
+func (h mongoHandle) Remove(ctx context.Context, filename string) (err error) {
+	return h.with(ctx, func(gfs *mgo.GridFS) error {
+		return remove(gfs, strings.ToLower(filename))
+	})
 }
 
-// Find files by their MD5 checksum
-func (h mongoHandle) FindFilesByMd5(md5 string) (files []types.File, err error) {
-	err = h.Gfs.Find(bson.M{"md5": md5}).Sort("-metadata.timestamp").All(&files)
+// remove the files stored as filename, and their counts. Removing one that
+// shares its chunks with another revision moves that one into its place,
+// under another _id than was found, so the files are looked up again until
+// none are left.
+func remove(gfs *mgo.GridFS, filename string) error {
+	return removeAll(gfs, bson.M{"filename": filename})
+}
+
+// removeAll removes the files that query matches, as remove does
+func removeAll(gfs *mgo.GridFS, query bson.M) error {
+	for {
+		var docs []revision
+		if err := gfs.Find(query).All(&docs); err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		for _, doc := range docs {
+			err := removeFile(gfs, doc)
+			if err == mgo.ErrNotFound {
+				continue // someone else got to it first, or it was moved
+			} else if err != nil {
+				return err
+			}
+			if err := tally(gfs.Files.Database, doc.File, -1); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (h mongoHandle) RemoveRevision(ctx context.Context, filename string, n int) error {
+	revs, err := h.revisions(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > len(revs) {
+		return dbutil.ErrNotFound
+	}
+	doc := revs[n-1]
+	return h.with(ctx, func(gfs *mgo.GridFS) error {
+		if err := removeFile(gfs, doc); err == mgo.ErrNotFound {
+			return dbutil.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := tally(gfs.Files.Database, doc.File, -1); err != nil {
+			return err
+		}
+		if n < len(revs) || n == 1 || doc.Metadata.IsSuperseded() {
+			return nil
+		}
+		// the one before the current revision takes its place. It is read
+		// again, as removeFile may have moved it into the document removed.
+		var previous revision
+		err := gfs.Find(bson.M{"filename": doc.Filename}).Sort("-uploadDate").One(&previous)
+		if err == mgo.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		previous.Metadata.Superseded = time.Time{}
+		return unsupersede(gfs, []revision{previous})
+	})
+}
+
+// supersede marks the current file stored as filename as an earlier revision,
+// taking it out of the counts. The files it marked are returned, even with an
+// error, for unsupersede.
+func supersede(gfs *mgo.GridFS, filename string) ([]revision, error) {
+	var docs []revision
+	query := bson.M{"filename": filename, "metadata.superseded": bson.M{"$exists": false}}
+	if err := gfs.Find(query).Select(bson.M{"filename": 1, "metadata": 1}).All(&docs); err != nil {
+		return nil, err
+	}
+	ids := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.Id
+	}
+	if _, err := gfs.Files.UpdateAll(bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"metadata.superseded": time.Now()}}); err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if err := tally(gfs.Files.Database, doc.File, -1); err != nil {
+			return docs, err
+		}
+	}
+	return docs, nil
+}
+
+// unsupersede makes the files that supersede marked current again, for when
+// the new revision fails to take their place
+func unsupersede(gfs *mgo.GridFS, docs []revision) error {
+	for _, doc := range docs {
+		if err := gfs.Files.UpdateId(doc.Id, bson.M{"$unset": bson.M{"metadata.superseded": 1}}); err != nil {
+			return err
+		}
+		if err := tally(gfs.Files.Database, doc.File, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unfinished matches the files that Replace and CreateRevision are still
+// writing, under names of their own, for a $nor to leave them out of the
+// listings and counts
+var unfinished = []bson.M{{"filename": bson.RegEx{Pattern: `^\.(replacing|revising)-`}}}
+
+// Replace writes the new file under a name of its own, as the unique index on
+// filename would not have two, leaving it out of the listings until then. It
+// supersedes the file there, as CreateRevision does, takes filename over, and
+// only then removes the files there. Readers may briefly find neither in
+// between, but failing to take filename over leaves the file there in place.
+func (h mongoHandle) Replace(ctx context.Context, filename string) (file dbutil.File, err error) {
+	filename = strings.ToLower(filename)
+	file, err = h.Create(ctx, fmt.Sprintf(".replacing-%s-%s", bson.NewObjectId().Hex(), filename))
+	if err != nil {
+		return nil, err
+	}
+	file.(*gridFile).replaces = filename
+	return file, nil
+}
+
+// CreateRevision writes the new file under a name of its own too, and then
+// supersedes the file there before taking filename over. The unique index is
+// on filename and metadata.superseded together, so only one of the revisions
+// has none.
+func (h mongoHandle) CreateRevision(ctx context.Context, filename string) (file dbutil.File, err error) {
+	filename = strings.ToLower(filename)
+	file, err = h.Create(ctx, fmt.Sprintf(".revising-%s-%s", bson.NewObjectId().Hex(), filename))
+	if err != nil {
+		return nil, err
+	}
+	file.(*gridFile).revises = filename
+	return file, nil
+}
+
+func (h mongoHandle) OpenRevision(ctx context.Context, filename string, n int) (dbutil.File, error) {
+	revs, err := h.revisions(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n > len(revs) {
+		return nil, dbutil.ErrNotFound
+	}
+	s, err := h.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return openFile(ctx, s, s.DB(h.FileDb.Name).GridFS("fs"), revs[n-1])
+}
+
+// revision is a file document, along with its id, and that of the file whose
+// chunks it shares, if it does
+type revision struct {
+	Id         interface{} `bson:"_id"`
+	Blob       interface{} `bson:"blob,omitempty"`
+	types.File `bson:",inline"`
+}
+
+// revisions are the files stored as filename, oldest first
+func (h mongoHandle) revisions(ctx context.Context, filename string) (revs []revision, err error) {
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		return gfs.Find(bson.M{"filename": strings.ToLower(filename)}).Sort("uploadDate").All(&revs)
+	})
+	return revs, err
+}
+
+func (h mongoHandle) GetRevisions(ctx context.Context, filename string) ([]types.File, error) {
+	revs, err := h.revisions(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(revs) == 0 {
+		return nil, dbutil.ErrNotFound
+	}
+	files := make([]types.File, len(revs))
+	for i, rev := range revs {
+		files[i] = rev.File
+	}
+	return files, nil
+}
+
+func (h mongoHandle) UpdateInfo(ctx context.Context, filename string, info types.Info) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { *i = info })
+}
+
+func (h mongoHandle) AddKeywords(ctx context.Context, filename string, keywords ...string) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { i.AddKeywords(keywords...) })
+}
+
+func (h mongoHandle) RemoveKeywords(ctx context.Context, filename string, keywords ...string) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { i.RemoveKeywords(keywords...) })
+}
+
+// updateInfo changes the metadata of the files stored as filename with fn
+func (h mongoHandle) updateInfo(ctx context.Context, filename string, fn func(info *types.Info)) error {
+	return h.change(ctx, strings.ToLower(filename), func(f *types.File) bool {
+		if f.Metadata.IsSuperseded() {
+			return false
+		}
+		fn(&f.Metadata)
+		return true
+	})
+}
+
+func (h mongoHandle) Rename(ctx context.Context, from, to string) error {
+	from, to = strings.ToLower(from), strings.ToLower(to)
+	if exists, err := h.HasFileByFilename(ctx, to); err != nil {
+		return err
+	} else if exists {
+		return dbutil.ErrExists
+	}
+	err := h.change(ctx, from, func(f *types.File) bool {
+		f.Filename = to
+		f.Metadata.RenamedFrom(from, to)
+		return true
+	})
+	if mgo.IsDup(err) {
+		return dbutil.ErrExists
+	}
+	return err
+}
+
+// change applies fn to the files stored as filename, and sets those it changed
+// modified. A concurrent change to the same file may be lost.
+func (h mongoHandle) change(ctx context.Context, filename string, fn func(f *types.File) bool) error {
+	now := time.Now()
+	return h.with(ctx, func(gfs *mgo.GridFS) error {
+		var docs []revision
+		query := bson.M{"filename": filename}
+		if err := gfs.Find(query).Select(bson.M{"filename": 1, "metadata": 1}).All(&docs); err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return dbutil.ErrNotFound
+		}
+		for _, doc := range docs {
+			before := doc.File
+			doc.Metadata.Keywords = append([]string{}, doc.Metadata.Keywords...)
+			doc.Metadata.Renamed = append([]string{}, doc.Metadata.Renamed...)
+			if fn(&doc.File) {
+				doc.Metadata.Modified = now
+			}
+			if err := gfs.Files.UpdateId(doc.Id, bson.M{"$set": bson.M{"filename": doc.Filename, "metadata": doc.Metadata}}); err != nil {
+				return err
+			}
+			if err := tally(gfs.Files.Database, before, -1); err != nil {
+				return err
+			}
+			if err := tally(gfs.Files.Database, doc.File, 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// find the page of files matching query, most recent first. Earlier
+// revisions are left out, and so is the trash, unless it is what the query is
+// for.
+func (h mongoHandle) find(ctx context.Context, query bson.M, page dbutil.Page) (files []types.File, err error) {
+	if _, ok := query["metadata.deleted"]; !ok {
+		query["metadata.deleted"] = bson.M{"$exists": false}
+	}
+	query["metadata.superseded"] = bson.M{"$exists": false}
+	query["$nor"] = unfinished
+	if !page.Before.IsZero() {
+		query["metadata.timestamp"] = bson.M{"$lt": page.Before}
+	}
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		q := gfs.Find(query).Sort("-metadata.timestamp").Skip(page.Offset)
+		if page.Limit > 0 {
+			q = q.Limit(page.Limit)
+		}
+		return q.All(&files)
+	})
 	return files, err
 }
 
+// count the files matching query
+func (h mongoHandle) count(ctx context.Context, query interface{}) (count int, err error) {
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		count, err = gfs.Find(query).Count()
+		return err
+	})
+	return count, err
+}
+
+// Find files by their MD5 checksum
+func (h mongoHandle) FindFilesByMd5(ctx context.Context, md5 string, page dbutil.Page) (files []types.File, err error) {
+	return h.find(ctx, bson.M{"md5": md5}, page)
+}
+
 // match for file name
 // XXX this is not used
-func (h mongoHandle) FindFilesByName(filename string) (files []types.File, err error) {
-	err = h.Gfs.Find(bson.M{"filename": filename}).Sort("-metadata.timestamp").All(&files)
-	return files, err
+func (h mongoHandle) FindFilesByName(ctx context.Context, filename string) (files []types.File, err error) {
+	return h.find(ctx, bson.M{"filename": filename}, dbutil.Page{})
 }
 
 // Case-insensitive pattern match for file name
-func (h mongoHandle) FindFilesByPatt(filenamePat string) (files []types.File, err error) {
-	err = h.Gfs.Find(bson.M{"filename": bson.M{"$regex": filenamePat, "$options": "i"}}).Sort("-metadata.timestamp").All(&files)
-	return files, err
+func (h mongoHandle) FindFilesByPatt(ctx context.Context, filenamePat string, page dbutil.Page) (files []types.File, err error) {
+	return h.find(ctx, bson.M{"filename": bson.M{"$regex": filenamePat, "$options": "i"}}, page)
 }
 
 // Case-insensitive pattern match for file name
-func (h mongoHandle) FindFilesByKeyword(keyword string) (files []types.File, err error) {
-	err = h.Gfs.Find(bson.M{"metadata.keywords": strings.ToLower(keyword)}).Sort("-metadata.timestamp").All(&files)
-	return files, err
+func (h mongoHandle) FindFilesByKeyword(ctx context.Context, keyword string, page dbutil.Page) (files []types.File, err error) {
+	return h.find(ctx, bson.M{"metadata.keywords": strings.ToLower(keyword)}, page)
 }
 
-// Get all the files.
-// Pass -1 for all files.
-func (h mongoHandle) GetFiles(limit int) (files []types.File, err error) {
-	//files = []types.File{}
-	if limit == -1 {
-		err = h.Gfs.Find(nil).Sort("-metadata.timestamp").All(&files)
-	} else {
-		err = h.Gfs.Find(nil).Sort("-metadata.timestamp").Limit(limit).All(&files)
-	}
+// Get a page of all the files.
+func (h mongoHandle) GetFiles(ctx context.Context, page dbutil.Page) (files []types.File, err error) {
+	return h.find(ctx, bson.M{}, page)
+}
+
+// Get a page of the files in the trash.
+func (h mongoHandle) GetTrash(ctx context.Context, page dbutil.Page) (files []types.File, err error) {
+	return h.find(ctx, bson.M{"metadata.deleted": bson.M{"$exists": true}}, page)
+}
+
+// Get the files that have expired by t.
+func (h mongoHandle) GetExpired(ctx context.Context, t time.Time) (files []types.File, err error) {
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		return gfs.Find(bson.M{
+			"metadata.expires":    bson.M{"$lte": t},
+			"metadata.superseded": bson.M{"$exists": false},
+			"$nor":                unfinished,
+		}).All(&files)
+	})
 	return files, err
 }
 
+// Orphans lists the files_id of the chunks that have no file.
+func (h mongoHandle) Orphans(ctx context.Context) (ids []string, err error) {
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		var groups []struct {
+			Id bson.ObjectId `bson:"_id"`
+		}
+		err := gfs.Chunks.Pipe([]bson.M{
+			{"$group": bson.M{"_id": "$files_id"}},
+			{"$lookup": bson.M{"from": gfs.Files.Name, "localField": "_id", "foreignField": "_id", "as": "file"}},
+			{"$match": bson.M{"file": bson.M{"$size": 0}}},
+		}).All(&groups)
+		for _, g := range groups {
+			ids = append(ids, g.Id.Hex())
+		}
+		return err
+	})
+	return ids, err
+}
+
 // Count the filename matches
-func (h mongoHandle) CountFiles(filename string) (count int, err error) {
-	query := h.Gfs.Find(bson.M{"filename": strings.ToLower(filename)})
-	return query.Count()
+func (h mongoHandle) CountFiles(ctx context.Context, filename string) (count int, err error) {
+	return h.count(ctx, bson.M{"filename": strings.ToLower(filename)})
 }
 
 // Get one file back, by searching by file name
-func (h mongoHandle) GetFileByFilename(filename string) (thisFile types.File, err error) {
-	err = h.Gfs.Find(bson.M{"filename": strings.ToLower(filename)}).One(&thisFile)
-	if err != nil {
+func (h mongoHandle) GetFileByFilename(ctx context.Context, filename string) (thisFile types.File, err error) {
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		return gfs.Find(bson.M{"filename": strings.ToLower(filename)}).Sort("-uploadDate").One(&thisFile)
+	})
+	if err == mgo.ErrNotFound {
+		return thisFile, dbutil.ErrNotFound
+	} else if err != nil {
 		return thisFile, err
 	}
 	return thisFile, nil
 }
 
+func (h mongoHandle) GetFileByFormerName(ctx context.Context, filename string) (thisFile types.File, err error) {
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		return gfs.Find(bson.M{"metadata.renamed": strings.ToLower(filename)}).Sort("-metadata.modified").One(&thisFile)
+	})
+	if err == mgo.ErrNotFound {
+		return thisFile, dbutil.ErrNotFound
+	}
+	return thisFile, err
+}
+
+// Pick a file, by the first at or after pick.Random in the metadata.random
+// index, or else the first of all.
+func (h mongoHandle) GetRandomFile(ctx context.Context, pick dbutil.Pick) (thisFile types.File, err error) {
+	query := randomQuery(pick)
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		query["metadata.random"] = bson.M{"$gte": pick.Random}
+		err := gfs.Find(query).Sort("metadata.random").One(&thisFile)
+		if err == mgo.ErrNotFound {
+			delete(query, "metadata.random")
+			err = gfs.Find(query).Sort("metadata.random").One(&thisFile)
+		}
+		return err
+	})
+	if err == mgo.ErrNotFound {
+		return thisFile, dbutil.ErrNotFound
+	}
+	return thisFile, err
+}
+
+// randomQuery is for the files in the listings that pick is narrowed down to
+func randomQuery(pick dbutil.Pick) bson.M {
+	query := bson.M{
+		"metadata.deleted":    bson.M{"$exists": false},
+		"metadata.superseded": bson.M{"$exists": false},
+		"$nor":                unfinished,
+		// expired files are left out, though they may not be removed yet
+		"$or": []bson.M{
+			{"metadata.expires": bson.M{"$exists": false}},
+			{"metadata.expires": bson.M{"$gt": time.Now()}},
+		},
+	}
+	if len(pick.Keyword) > 0 {
+		query["metadata.keywords"] = strings.ToLower(pick.Keyword)
+	}
+	if len(pick.Extension) > 0 {
+		query["filename"] = bson.M{"$regex": `(^|\.)` + regexp.QuoteMeta(pick.Extension) + "$", "$options": "i"}
+	}
+	return query
+}
+
 // Check whether this types.File filename is on Mongo
-func (h mongoHandle) HasFileByFilename(filename string) (exists bool, err error) {
-	c, err := h.CountFiles(filename)
+func (h mongoHandle) HasFileByFilename(ctx context.Context, filename string) (exists bool, err error) {
+	c, err := h.CountFiles(ctx, filename)
 	if err != nil {
 		return false, err
 	}
@@ -144,8 +612,8 @@ func (h mongoHandle) HasFileByFilename(filename string) (exists bool, err error)
 }
 
 // XXX this is not used
-func (h mongoHandle) HasFileByMd5(md5 string) (exists bool, err error) {
-	c, err := h.Gfs.Find(bson.M{"md5": md5}).Count()
+func (h mongoHandle) HasFileByMd5(ctx context.Context, md5 string) (exists bool, err error) {
+	c, err := h.count(ctx, bson.M{"md5": md5})
 	if err != nil {
 		return false, err
 	}
@@ -154,8 +622,8 @@ func (h mongoHandle) HasFileByMd5(md5 string) (exists bool, err error) {
 }
 
 // XXX this is not used
-func (h mongoHandle) HasFileByKeyword(keyword string) (exists bool, err error) {
-	c, err := h.Gfs.Find(bson.M{"metadata": bson.M{"keywords": strings.ToLower(keyword)}}).Count()
+func (h mongoHandle) HasFileByKeyword(ctx context.Context, keyword string) (exists bool, err error) {
+	c, err := h.count(ctx, bson.M{"metadata": bson.M{"keywords": strings.ToLower(keyword)}})
 	if err != nil {
 		return false, err
 	}
@@ -164,73 +632,341 @@ func (h mongoHandle) HasFileByKeyword(keyword string) (exists bool, err error) {
 }
 
 // get a list of file extensions and their frequency count
-func (h mongoHandle) GetExtensions() (kp []types.IdCount, err error) {
-	job := &mgo.MapReduce{
-		Map: `
-    function() {
-        if (!this.filename) {
-          return;
-        }
-
-        s = this.filename.split(".")
-        ext = s[s.length - 1] // get the last segment of the split
-        emit(ext,1);
-    }
-    `,
-		Reduce: `
-    function(previous, current) {
-      var count = 0;
-
-      for (index in current) {
-        count += current[index];
-      }
-
-      return count;
-    }
-    `,
-	}
-	if _, err := h.Gfs.Find(nil).MapReduce(job, &kp); err != nil {
-		return kp, err
-	}
-	// Less than effecient, but cleanest place to put this
-	for i := range kp {
-		kp[i].Root = "ext" // for extension. Maps to /ext/
-	}
-	return kp, nil
+func (h mongoHandle) GetExtensions(ctx context.Context) (kp []types.IdCount, err error) {
+	return h.counts(ctx, extensionsCollection, "ext") // for extension. Maps to /ext/
 }
 
 // get a list of keywords and their frequency count
-func (h mongoHandle) GetKeywords() (kp []types.IdCount, err error) {
-	job := &mgo.MapReduce{
-		Map: `
-    function() {
-        if (!this.metadata.keywords) {
-          return;
-        }
-
-        for (index in this.metadata.keywords) {
-          emit(this.metadata.keywords[index], 1);
-        }
-    }
-    `,
-		Reduce: `
-    function(previous, current) {
-      var count = 0;
-
-      for (index in current) {
-        count += current[index];
-      }
-
-      return count;
-    }
-    `,
-	}
-	if _, err := h.Gfs.Find(nil).MapReduce(job, &kp); err != nil {
-		return kp, err
-	}
-	// Less than effecient, but cleanest place to put this
+func (h mongoHandle) GetKeywords(ctx context.Context) (kp []types.IdCount, err error) {
+	return h.counts(ctx, keywordsCollection, "k") // for keyword. Maps to /k/
+}
+
+func (h mongoHandle) counts(ctx context.Context, collection, root string) (kp []types.IdCount, err error) {
+	err = h.with(ctx, func(gfs *mgo.GridFS) error {
+		return gfs.Files.Database.C(collection).Find(bson.M{"value": bson.M{"$gt": 0}}).Sort("_id").All(&kp)
+	})
 	for i := range kp {
-		kp[i].Root = "k" // for keyword. Maps to /k/
+		kp[i].Root = root
+	}
+	return kp, err
+}
+
+// The keyword and extension counts are kept up to date as files are created
+// and removed, in collections of {_id: value, value: count}, rather than
+// running a MapReduce over every file for each tag cloud.
+const (
+	keywordsCollection   = "fs.keywords"
+	extensionsCollection = "fs.extensions"
+)
+
+func extension(filename string) string {
+	s := strings.Split(filename, ".")
+	return s[len(s)-1] // get the last segment of the split
+}
+
+// tally adds delta to the counts for the file's keywords and extension,
+// unless it is hidden
+func tally(db *mgo.Database, f types.File, delta int) error {
+	if f.Metadata.Hidden() {
+		return nil
+	}
+	inc := bson.M{"$inc": bson.M{"value": delta}}
+	for _, k := range f.Metadata.Keywords {
+		if _, err := db.C(keywordsCollection).UpsertId(k, inc); err != nil {
+			return err
+		}
+	}
+	if len(f.Filename) > 0 {
+		if _, err := db.C(extensionsCollection).UpsertId(extension(f.Filename), inc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Uploads of the same contents are stored once. fs.blobs has a
+// {_id: md5, files_id: id, refs: count} for each md5 that is shared, where
+// files_id is the file that owns the chunks, and the files that share them
+// have it as their blob. A file is only ever moved into the owner's document,
+// so that the others need not be changed. Without transactions, a crash or a
+// race part way through can leave a blob with a count too high, which only
+// keeps its chunks around; it never has them removed from under a file.
+const blobsCollection = "fs.blobs"
+
+type blob struct {
+	Md5     string      `bson:"_id"`
+	FilesId interface{} `bson:"files_id"`
+	Refs    int         `bson:"refs"`
+}
+
+// share has the file with id read the chunks already stored for its md5, and
+// drops its own, or else records its chunks as the ones for the md5. A file
+// that can not share keeps its chunks.
+func share(gfs *mgo.GridFS, id interface{}, md5 string) error {
+	blobs := gfs.Files.Database.C(blobsCollection)
+	var b blob
+	err := blobs.FindId(md5).One(&b)
+	if err == mgo.ErrNotFound {
+		err = blobs.Insert(blob{Md5: md5, FilesId: id, Refs: 1})
+		if mgo.IsDup(err) {
+			return nil // another upload of the same contents got there first
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	// the file points at the blob before it is counted, so that the owner can
+	// always find a file to hand over to, while the count is above one
+	if err := gfs.Files.UpdateId(id, bson.M{"$set": bson.M{"blob": b.FilesId}}); err != nil {
+		return err
+	}
+	err = blobs.Update(bson.M{"_id": md5, "files_id": b.FilesId, "refs": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"refs": 1}})
+	if err != nil {
+		gfs.Files.UpdateId(id, bson.M{"$unset": bson.M{"blob": 1}})
+		if err == mgo.ErrNotFound {
+			return nil // the owner let go of the blob in the meantime
+		}
+		return err
+	}
+	_, err = gfs.Chunks.RemoveAll(bson.M{"files_id": id})
+	return err
+}
+
+// removeFile removes the file document doc, and its chunks, unless other files
+// share them. Then one of those is moved into doc in its place, keeping the
+// chunks. The file already being removed is mgo.ErrNotFound.
+func removeFile(gfs *mgo.GridFS, doc revision) error {
+	blobs := gfs.Files.Database.C(blobsCollection)
+	if doc.Blob != nil {
+		if err := gfs.Files.RemoveId(doc.Id); err != nil {
+			return err
+		}
+		err := blobs.Update(bson.M{"_id": doc.Md5, "files_id": doc.Blob}, bson.M{"$inc": bson.M{"refs": -1}})
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	var b blob
+	if err := blobs.Find(bson.M{"_id": doc.Md5, "files_id": doc.Id}).One(&b); err == mgo.ErrNotFound {
+		return gfs.RemoveId(doc.Id) // not shared
+	} else if err != nil {
+		return err
+	}
+	err := blobs.Remove(bson.M{"_id": doc.Md5, "files_id": doc.Id, "refs": bson.M{"$lte": 1}})
+	if err == nil {
+		return gfs.RemoveId(doc.Id) // no longer shared
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+
+	var owner, other bson.M
+	if err := gfs.Files.FindId(doc.Id).One(&owner); err != nil {
+		return err
+	}
+	if err := gfs.Files.Find(bson.M{"blob": doc.Id}).One(&other); err == mgo.ErrNotFound {
+		// counted, but not shared after all
+		if err := blobs.RemoveId(doc.Md5); err != nil {
+			return err
+		}
+		return gfs.RemoveId(doc.Id)
+	} else if err != nil {
+		return err
+	}
+	if err := gfs.Files.RemoveId(other["_id"]); err != nil {
+		return err
+	}
+	delete(other, "_id")
+	delete(other, "blob")
+	other["chunkSize"] = owner["chunkSize"]
+	if err := gfs.Files.UpdateId(doc.Id, other); err != nil {
+		return err
+	}
+	return blobs.UpdateId(doc.Md5, bson.M{"$inc": bson.M{"refs": -1}})
+}
+
+// indexes are what the lookups and sorts on fs.files need. Filenames are
+// lowercased before they are stored, so the unique index on them is a
+// case-insensitive one. Earlier revisions of a file are told apart by when
+// they were superseded. Expired files are found by metadata.expires, and not
+// left to a TTL index, which would remove them from fs.files but leave their
+// chunks behind. Random picks walk metadata.random, by keyword or not. The
+// files sharing a blob are found by it, when its owner is removed.
+var indexes = []mgo.Index{
+	{Key: []string{"filename", "metadata.superseded"}, Unique: true},
+	{Key: []string{"md5"}},
+	{Key: []string{"metadata.keywords", "-metadata.timestamp"}},
+	{Key: []string{"-metadata.timestamp"}},
+	{Key: []string{"metadata.renamed"}},
+	{Key: []string{"metadata.expires"}, Sparse: true},
+	{Key: []string{"metadata.random"}},
+	{Key: []string{"metadata.keywords", "metadata.random"}},
+	{Key: []string{"blob"}, Sparse: true},
+}
+
+// ensureIndexes builds any of the indexes that are missing, logging how each
+// one went. A store that already has the same filename more than once, from
+// before the indexes, gets a plain index there instead of the unique one.
+func ensureIndexes(files *mgo.Collection) error {
+	for _, index := range indexes {
+		err := files.EnsureIndex(index)
+		if err != nil && index.Unique && mgo.IsDup(err) {
+			log.Printf("mongo: %s has duplicate %v, indexing without the unique constraint: %s", files.FullName, index.Key, err)
+			index.Unique = false
+			err = files.EnsureIndex(index)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("mongo: %s index on %v is ready (unique: %t)", files.FullName, index.Key, index.Unique)
+	}
+	return nil
+}
+
+// initCounts counts up the keywords and extensions of the files already
+// stored, the first time the counts are needed
+func initCounts(db *mgo.Database, gfs *mgo.GridFS) error {
+	names, err := db.CollectionNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == keywordsCollection || name == extensionsCollection {
+			return nil
+		}
+	}
+
+	keywords, exts := map[string]int{}, map[string]int{}
+	var f types.File
+	unhidden := bson.M{"metadata.deleted": bson.M{"$exists": false}, "metadata.superseded": bson.M{"$exists": false}, "$nor": unfinished}
+	iter := gfs.Find(unhidden).Select(bson.M{"filename": 1, "metadata.keywords": 1}).Iter()
+	for iter.Next(&f) {
+		for _, k := range f.Metadata.Keywords {
+			keywords[k]++
+		}
+		if len(f.Filename) > 0 {
+			exts[extension(f.Filename)]++
+		}
+		f = types.File{}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for name, counts := range map[string]map[string]int{keywordsCollection: keywords, extensionsCollection: exts} {
+		// so that an empty store is not counted up again
+		if err := db.C(name).Create(&mgo.CollectionInfo{}); err != nil {
+			return err
+		}
+		for id, value := range counts {
+			if _, err := db.C(name).UpsertId(id, bson.M{"$set": bson.M{"value": value}}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gridFile is a GridFile on its own session, that gives up once its ctx is
+// done, and can have its uploadDate set when open for writing. A file read
+// from the chunks it shares has its own metadata, rather than the GridFile's.
+type gridFile struct {
+	*mgo.GridFile
+	ctx        context.Context
+	session    *mgo.Session
+	gfs        *mgo.GridFS
+	info       *types.Info
+	uploadDate time.Time
+	writing    bool
+	replaces   string // filename to take over, once written
+	revises    string // filename to take over from the current revision, once written
+}
+
+func (f *gridFile) SetUploadDate(t time.Time) {
+	f.uploadDate = t
+}
+
+func (f *gridFile) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.GridFile.Read(p)
+}
+
+func (f *gridFile) Write(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		f.GridFile.Abort()
+		return 0, err
+	}
+	return f.GridFile.Write(p)
+}
+
+func (f *gridFile) Close() error {
+	defer f.session.Close()
+	if err := f.GridFile.Close(); err != nil && f.writing && mgo.IsDup(err) {
+		// mgo only cleans up the chunks when writing them fails
+		f.gfs.Chunks.RemoveAll(bson.M{"files_id": f.Id()})
+		return dbutil.ErrExists
+	} else if err != nil || !f.writing {
+		return err
+	}
+	set := bson.M{}
+	if !f.uploadDate.IsZero() {
+		set["uploadDate"] = f.uploadDate
+	}
+	// a file that fails to take its filename is not left under its own
+	var superseded []revision
+	if takes := f.replaces + f.revises; len(takes) > 0 {
+		var err error
+		if superseded, err = supersede(f.gfs, takes); err != nil {
+			unsupersede(f.gfs, superseded)
+			f.gfs.RemoveId(f.Id())
+			return err
+		}
+		set["filename"] = takes
+	}
+	if len(set) > 0 {
+		if err := f.gfs.Files.UpdateId(f.Id(), bson.M{"$set": set}); err != nil {
+			if _, ok := set["filename"]; ok {
+				unsupersede(f.gfs, superseded)
+				f.gfs.RemoveId(f.Id())
+			}
+			return err
+		}
+	}
+	if len(f.replaces) > 0 {
+		// only now that the new file has the name are the ones it replaces
+		// removed, all of them being superseded and uncounted by now
+		query := bson.M{"filename": f.replaces, "_id": bson.M{"$ne": f.Id()}}
+		if err := removeAll(f.gfs, query); err != nil {
+			log.Printf("mongo: [%s] keeps the files it replaced, as earlier revisions: %s", f.replaces, err)
+		}
+	}
+	doc := types.File{Filename: f.Name()}
+	if name, ok := set["filename"].(string); ok {
+		doc.Filename = name
+	}
+	if err := f.GetMeta(&doc.Metadata); err != nil {
+		return err
+	}
+	if err := tally(f.gfs.Files.Database, doc, 1); err != nil {
+		return err
+	}
+	if err := share(f.gfs, f.Id(), f.MD5()); err != nil {
+		log.Printf("mongo: [%s] keeps its own chunks: %s", doc.Filename, err)
+	}
+	return nil
+}
+
+func (f *gridFile) GetMeta(result interface{}) error {
+	if f.info == nil {
+		return f.GridFile.GetMeta(result)
+	}
+	buf, err := bson.Marshal(f.info)
+	if err != nil {
+		return err
 	}
-	return kp, nil
+	return bson.Unmarshal(buf, result)
 }
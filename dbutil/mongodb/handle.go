@@ -0,0 +1,1130 @@
+/*
+Package mongodb is the "mongodb" dbutil.Handler, using the official MongoDB Go
+driver and its GridFS bucket API.
+
+It keeps the same GridFS layout as the "mongo" handler (fs.files and
+fs.chunks, with metadata.keywords and metadata.timestamp), so either can be
+pointed at an existing store. Unlike labix.org/v2/mgo, the driver talks to
+current MongoDB server versions, SCRAM-SHA-256 and TLS.
+
+Like the "fs", "s3" and "bolt" handlers, it stores uploads of the same
+contents once. They share the chunks of the first of them, as recorded in
+fs.blobs, which the "mongo" handler keeps the same way.
+*/
+package mongodb
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func init() {
+	dbutil.Handles["mongodb"] = &mongoHandle{}
+}
+
+const (
+	defaultDbName  = "filesrv"
+	connectTimeout = 30 * time.Second
+	indexTimeout   = 10 * time.Minute // building indexes on a large store takes a while
+)
+
+var errNotWriting = errors.New("mongodb: file is not open for writing")
+
+type dbConfig struct {
+	Seed   string // mongo host seed, or a full mongodb:// connection string
+	User   string // mongo credentials, if needed
+	Pass   string // mongo credentials, if needed
+	DbName string // mongo database name, if needed
+}
+
+type mongoHandle struct {
+	config dbConfig
+	Client *mongo.Client
+	FileDb *mongo.Database
+	Bucket *gridfs.Bucket
+	Files  *mongo.Collection
+}
+
+func (h *mongoHandle) Init(config []byte, err error) error {
+	if err != nil {
+		return err
+	}
+
+	h.config = dbConfig{}
+	if err := json.Unmarshal(config, &h.config); err != nil {
+		return err
+	}
+	if len(h.config.DbName) == 0 {
+		h.config.DbName = defaultDbName
+	}
+
+	uri := h.config.Seed
+	if !strings.HasPrefix(uri, "mongodb://") && !strings.HasPrefix(uri, "mongodb+srv://") {
+		uri = "mongodb://" + uri
+	}
+	opts := options.Client().ApplyURI(uri)
+	if len(h.config.User) > 0 && len(h.config.Pass) > 0 {
+		opts.SetAuth(options.Credential{
+			Username:   h.config.User,
+			Password:   h.config.Pass,
+			AuthSource: h.config.DbName,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	h.Client, err = mongo.Connect(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if err := h.Client.Ping(ctx, nil); err != nil {
+		return err
+	}
+
+	h.FileDb = h.Client.Database(h.config.DbName)
+	h.Bucket, err = gridfs.NewBucket(h.FileDb)
+	if err != nil {
+		return err
+	}
+	h.Files = h.Bucket.GetFilesCollection()
+	if err := h.ensureIndexes(); err != nil {
+		return err
+	}
+	return h.initCounts(ctx)
+}
+
+func (h *mongoHandle) Close() error {
+	return h.Client.Disconnect(context.Background())
+}
+
+// GridFS streams take deadlines rather than contexts, so they give up at the
+// ctx deadline, and otherwise notice cancellation between Reads or Writes
+
+func (h *mongoHandle) Open(ctx context.Context, filename string) (dbutil.File, error) {
+	var doc revision
+	err := h.Files.FindOne(ctx,
+		bson.M{"filename": strings.ToLower(filename)},
+		options.FindOne().SetSort(bson.M{"uploadDate": -1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, dbutil.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return h.open(ctx, doc)
+}
+
+// open the file document doc, reading the chunks of the file it shares them
+// with, if it does
+func (h *mongoHandle) open(ctx context.Context, doc revision) (dbutil.File, error) {
+	id := doc.Id
+	if doc.Blob != nil {
+		id = doc.Blob
+	}
+	ds, err := h.Bucket.OpenDownloadStream(id)
+	if err == gridfs.ErrFileNotFound {
+		return nil, dbutil.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := ds.SetReadDeadline(deadline); err != nil {
+			ds.Close()
+			return nil, err
+		}
+	}
+	f := &downloadFile{h: h, ctx: ctx, ds: ds}
+	if doc.Blob != nil {
+		f.info = &doc.Metadata
+	}
+	return f, nil
+}
+
+func (h *mongoHandle) Create(ctx context.Context, filename string) (dbutil.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &uploadFile{
+		h:        h,
+		ctx:      ctx,
+		filename: strings.ToLower(filename),
+		sum:      md5.New(),
+	}, nil
+}
+
+// CreateNew relies on the unique index on filename, which fails the insert of
+// a second file of the same name, once its chunks are written. Without the
+// index, only the check up front is done.
+func (h *mongoHandle) CreateNew(ctx context.Context, filename string) (dbutil.File, error) {
+	if exists, err := h.HasFileByFilename(ctx, filename); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, dbutil.ErrExists
+	}
+	return h.Create(ctx, filename)
+}
+
+// Replace writes the new file under a name of its own, as the unique index on
+// filename would not have two, leaving it out of the listings until then. It
+// supersedes the file there, as CreateRevision does, takes filename over, and
+// only then removes the files there. Readers may briefly find neither in
+// between, but failing to take filename over leaves the file there in place.
+func (h *mongoHandle) Replace(ctx context.Context, filename string) (dbutil.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	filename = strings.ToLower(filename)
+	return &uploadFile{
+		h:        h,
+		ctx:      ctx,
+		filename: fmt.Sprintf(".replacing-%s-%s", primitive.NewObjectID().Hex(), filename),
+		replaces: filename,
+		sum:      md5.New(),
+	}, nil
+}
+
+// CreateRevision writes the new file under a name of its own too, and then
+// supersedes the file there before taking filename over. The unique index is
+// on filename and metadata.superseded together, so only one of the revisions
+// has none.
+func (h *mongoHandle) CreateRevision(ctx context.Context, filename string) (dbutil.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	filename = strings.ToLower(filename)
+	return &uploadFile{
+		h:        h,
+		ctx:      ctx,
+		filename: fmt.Sprintf(".revising-%s-%s", primitive.NewObjectID().Hex(), filename),
+		revises:  filename,
+		sum:      md5.New(),
+	}, nil
+}
+
+func (h *mongoHandle) OpenRevision(ctx context.Context, filename string, n int) (dbutil.File, error) {
+	revs, err := h.revisions(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n > len(revs) {
+		return nil, dbutil.ErrNotFound
+	}
+	return h.open(ctx, revs[n-1])
+}
+
+// revision is a file document, along with its id, and that of the file whose
+// chunks it shares, if it does
+type revision struct {
+	Id         interface{} `bson:"_id"`
+	Blob       interface{} `bson:"blob,omitempty"`
+	types.File `bson:",inline"`
+}
+
+// revisions are the files stored as filename, oldest first
+func (h *mongoHandle) revisions(ctx context.Context, filename string) ([]revision, error) {
+	cur, err := h.Files.Find(ctx,
+		bson.M{"filename": strings.ToLower(filename)},
+		options.Find().SetSort(bson.M{"uploadDate": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var revs []revision
+	err = cur.All(ctx, &revs)
+	return revs, err
+}
+
+// supersede marks the current file stored as filename as an earlier revision,
+// taking it out of the counts. The files it marked are returned, even with an
+// error, for unsupersede.
+func (h *mongoHandle) supersede(ctx context.Context, filename string) ([]revision, error) {
+	filter := bson.M{"filename": filename, "metadata.superseded": bson.M{"$exists": false}}
+	cur, err := h.Files.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "filename": 1, "metadata": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []revision
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	ids := make(bson.A, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.Id
+	}
+	if _, err := h.Files.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"metadata.superseded": time.Now()}}); err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if err := h.tally(ctx, doc.File, -1); err != nil {
+			return docs, err
+		}
+	}
+	return docs, nil
+}
+
+// unsupersede makes the files that supersede marked current again, for when
+// the new revision fails to take their place
+func (h *mongoHandle) unsupersede(ctx context.Context, docs []revision) error {
+	for _, doc := range docs {
+		if _, err := h.Files.UpdateByID(ctx, doc.Id, bson.M{"$unset": bson.M{"metadata.superseded": 1}}); err != nil {
+			return err
+		}
+		if err := h.tally(ctx, doc.File, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unfinished matches the files that Replace and CreateRevision are still
+// writing, under names of their own, for a $nor to leave them out of the
+// listings and counts
+var unfinished = bson.A{bson.M{"filename": primitive.Regex{Pattern: `^\.(replacing|revising)-`}}}
+
+// Remove removes every revision stored as filename. Removing one that shares
+// its chunks with another revision moves that one into its place, under
+// another _id than was found, so the files are looked up again until none
+// are left.
+func (h *mongoHandle) Remove(ctx context.Context, filename string) error {
+	return h.removeAll(ctx, bson.M{"filename": strings.ToLower(filename)})
+}
+
+// removeAll removes the files that filter matches, as Remove does
+func (h *mongoHandle) removeAll(ctx context.Context, filter bson.M) error {
+	for {
+		cur, err := h.Files.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		var docs []revision
+		if err := cur.All(ctx, &docs); err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		for _, doc := range docs {
+			err := h.removeFile(ctx, doc)
+			if err == gridfs.ErrFileNotFound {
+				continue // someone else got to it first, or it was moved
+			} else if err != nil {
+				return err
+			}
+			if err := h.tally(ctx, doc.File, -1); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (h *mongoHandle) RemoveRevision(ctx context.Context, filename string, n int) error {
+	revs, err := h.revisions(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > len(revs) {
+		return dbutil.ErrNotFound
+	}
+	doc := revs[n-1]
+	if err := h.removeFile(ctx, doc); err == gridfs.ErrFileNotFound {
+		return dbutil.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := h.tally(ctx, doc.File, -1); err != nil {
+		return err
+	}
+	if n < len(revs) || n == 1 || doc.Metadata.IsSuperseded() {
+		return nil
+	}
+	// the one before the current revision takes its place. It is read again,
+	// as removeFile may have moved it into the document removed.
+	var previous revision
+	err = h.Files.FindOne(ctx,
+		bson.M{"filename": doc.Filename},
+		options.FindOne().SetSort(bson.M{"uploadDate": -1})).Decode(&previous)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	previous.Metadata.Superseded = time.Time{}
+	return h.unsupersede(ctx, []revision{previous})
+}
+
+func (h *mongoHandle) UpdateInfo(ctx context.Context, filename string, info types.Info) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { *i = info })
+}
+
+func (h *mongoHandle) AddKeywords(ctx context.Context, filename string, keywords ...string) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { i.AddKeywords(keywords...) })
+}
+
+func (h *mongoHandle) RemoveKeywords(ctx context.Context, filename string, keywords ...string) error {
+	return h.updateInfo(ctx, filename, func(i *types.Info) { i.RemoveKeywords(keywords...) })
+}
+
+// updateInfo changes the metadata of the files stored as filename with fn
+func (h *mongoHandle) updateInfo(ctx context.Context, filename string, fn func(info *types.Info)) error {
+	return h.change(ctx, strings.ToLower(filename), func(f *types.File) bool {
+		if f.Metadata.IsSuperseded() {
+			return false
+		}
+		fn(&f.Metadata)
+		return true
+	})
+}
+
+func (h *mongoHandle) Rename(ctx context.Context, from, to string) error {
+	from, to = strings.ToLower(from), strings.ToLower(to)
+	if exists, err := h.HasFileByFilename(ctx, to); err != nil {
+		return err
+	} else if exists {
+		return dbutil.ErrExists
+	}
+	err := h.change(ctx, from, func(f *types.File) bool {
+		f.Filename = to
+		f.Metadata.RenamedFrom(from, to)
+		return true
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return dbutil.ErrExists
+	}
+	return err
+}
+
+// change applies fn to the files stored as filename, and sets those it changed
+// modified. A concurrent change to the same file may be lost.
+func (h *mongoHandle) change(ctx context.Context, filename string, fn func(f *types.File) bool) error {
+	now := time.Now()
+	cur, err := h.Files.Find(ctx,
+		bson.M{"filename": filename},
+		options.Find().SetProjection(bson.M{"_id": 1, "filename": 1, "metadata": 1}))
+	if err != nil {
+		return err
+	}
+	var docs []revision
+	if err := cur.All(ctx, &docs); err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return dbutil.ErrNotFound
+	}
+	for _, doc := range docs {
+		before := doc.File
+		doc.Metadata.Keywords = append([]string{}, doc.Metadata.Keywords...)
+		doc.Metadata.Renamed = append([]string{}, doc.Metadata.Renamed...)
+		if fn(&doc.File) {
+			doc.Metadata.Modified = now
+		}
+		if _, err := h.Files.UpdateByID(ctx, doc.Id, bson.M{"$set": bson.M{"filename": doc.Filename, "metadata": doc.Metadata}}); err != nil {
+			return err
+		}
+		if err := h.tally(ctx, before, -1); err != nil {
+			return err
+		}
+		if err := h.tally(ctx, doc.File, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find the page of files matching filter, most recent first. Earlier
+// revisions are left out, and so is the trash, unless it is what the filter is
+// for.
+func (h *mongoHandle) find(ctx context.Context, filter bson.M, page dbutil.Page) (files []types.File, err error) {
+	if _, ok := filter["metadata.deleted"]; !ok {
+		filter["metadata.deleted"] = bson.M{"$exists": false}
+	}
+	filter["metadata.superseded"] = bson.M{"$exists": false}
+	filter["$nor"] = unfinished
+	if !page.Before.IsZero() {
+		filter["metadata.timestamp"] = bson.M{"$lt": page.Before}
+	}
+	opts := options.Find().SetSort(bson.M{"metadata.timestamp": -1}).SetSkip(int64(page.Offset))
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit))
+	}
+	cur, err := h.Files.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = cur.All(ctx, &files)
+	return files, err
+}
+
+// Find files by their MD5 checksum
+func (h *mongoHandle) FindFilesByMd5(ctx context.Context, md5 string, page dbutil.Page) ([]types.File, error) {
+	return h.find(ctx, bson.M{"md5": md5}, page)
+}
+
+// Case-insensitive pattern match for file name
+func (h *mongoHandle) FindFilesByPatt(ctx context.Context, filenamePat string, page dbutil.Page) ([]types.File, error) {
+	return h.find(ctx, bson.M{"filename": primitive.Regex{Pattern: filenamePat, Options: "i"}}, page)
+}
+
+// Files that have this keyword
+func (h *mongoHandle) FindFilesByKeyword(ctx context.Context, keyword string, page dbutil.Page) ([]types.File, error) {
+	return h.find(ctx, bson.M{"metadata.keywords": strings.ToLower(keyword)}, page)
+}
+
+// Get a page of all the files.
+func (h *mongoHandle) GetFiles(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+	return h.find(ctx, bson.M{}, page)
+}
+
+// Get a page of the files in the trash.
+func (h *mongoHandle) GetTrash(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+	return h.find(ctx, bson.M{"metadata.deleted": bson.M{"$exists": true}}, page)
+}
+
+// Get the files that have expired by t.
+func (h *mongoHandle) GetExpired(ctx context.Context, t time.Time) (files []types.File, err error) {
+	cur, err := h.Files.Find(ctx, bson.M{
+		"metadata.expires":    bson.M{"$lte": t},
+		"metadata.superseded": bson.M{"$exists": false},
+		"$nor":                unfinished,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = cur.All(ctx, &files)
+	return files, err
+}
+
+// Orphans lists the files_id of the chunks that have no file.
+func (h *mongoHandle) Orphans(ctx context.Context) ([]string, error) {
+	cur, err := h.Bucket.GetChunksCollection().Aggregate(ctx, mongo.Pipeline{
+		stage("$group", bson.M{"_id": "$files_id"}),
+		stage("$lookup", bson.M{"from": h.Files.Name(), "localField": "_id", "foreignField": "_id", "as": "file"}),
+		stage("$match", bson.M{"file": bson.M{"$size": 0}}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Id primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(groups))
+	for i, g := range groups {
+		ids[i] = g.Id.Hex()
+	}
+	return ids, nil
+}
+
+// Count the filename matches
+func (h *mongoHandle) CountFiles(ctx context.Context, filename string) (int, error) {
+	c, err := h.Files.CountDocuments(ctx, bson.M{"filename": strings.ToLower(filename)})
+	return int(c), err
+}
+
+// Get one file back, by searching by file name
+func (h *mongoHandle) GetFileByFilename(ctx context.Context, filename string) (thisFile types.File, err error) {
+	err = h.Files.FindOne(ctx,
+		bson.M{"filename": strings.ToLower(filename)},
+		options.FindOne().SetSort(bson.M{"uploadDate": -1})).Decode(&thisFile)
+	if err == mongo.ErrNoDocuments {
+		return thisFile, dbutil.ErrNotFound
+	}
+	return thisFile, err
+}
+
+// Pick a file, by the first at or after pick.Random in the metadata.random
+// index, or else the first of all.
+func (h *mongoHandle) GetRandomFile(ctx context.Context, pick dbutil.Pick) (thisFile types.File, err error) {
+	filter := randomFilter(pick)
+	opts := options.FindOne().SetSort(bson.M{"metadata.random": 1})
+	filter["metadata.random"] = bson.M{"$gte": pick.Random}
+	err = h.Files.FindOne(ctx, filter, opts).Decode(&thisFile)
+	if err == mongo.ErrNoDocuments {
+		delete(filter, "metadata.random")
+		err = h.Files.FindOne(ctx, filter, opts).Decode(&thisFile)
+	}
+	if err == mongo.ErrNoDocuments {
+		return thisFile, dbutil.ErrNotFound
+	}
+	return thisFile, err
+}
+
+// randomFilter is for the files in the listings that pick is narrowed down to
+func randomFilter(pick dbutil.Pick) bson.M {
+	filter := bson.M{
+		"metadata.deleted":    bson.M{"$exists": false},
+		"metadata.superseded": bson.M{"$exists": false},
+		"$nor":                unfinished,
+		// expired files are left out, though they may not be removed yet
+		"$or": bson.A{
+			bson.M{"metadata.expires": bson.M{"$exists": false}},
+			bson.M{"metadata.expires": bson.M{"$gt": time.Now()}},
+		},
+	}
+	if len(pick.Keyword) > 0 {
+		filter["metadata.keywords"] = strings.ToLower(pick.Keyword)
+	}
+	if len(pick.Extension) > 0 {
+		filter["filename"] = primitive.Regex{Pattern: `(^|\.)` + regexp.QuoteMeta(pick.Extension) + "$", Options: "i"}
+	}
+	return filter
+}
+
+func (h *mongoHandle) GetFileByFormerName(ctx context.Context, filename string) (thisFile types.File, err error) {
+	err = h.Files.FindOne(ctx,
+		bson.M{"metadata.renamed": strings.ToLower(filename)},
+		options.FindOne().SetSort(bson.M{"metadata.modified": -1})).Decode(&thisFile)
+	if err == mongo.ErrNoDocuments {
+		return thisFile, dbutil.ErrNotFound
+	}
+	return thisFile, err
+}
+
+func (h *mongoHandle) GetRevisions(ctx context.Context, filename string) ([]types.File, error) {
+	revs, err := h.revisions(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(revs) == 0 {
+		return nil, dbutil.ErrNotFound
+	}
+	files := make([]types.File, len(revs))
+	for i, rev := range revs {
+		files[i] = rev.File
+	}
+	return files, nil
+}
+
+// Check whether this types.File filename is on Mongo
+func (h *mongoHandle) HasFileByFilename(ctx context.Context, filename string) (bool, error) {
+	c, err := h.CountFiles(ctx, filename)
+	if err != nil {
+		return false, err
+	}
+	return c > 0, nil
+}
+
+// get a list of file extensions and their frequency count
+func (h *mongoHandle) GetExtensions(ctx context.Context) ([]types.IdCount, error) {
+	return h.counts(ctx, extensionsCollection, "ext")
+}
+
+// get a list of keywords and their frequency count
+func (h *mongoHandle) GetKeywords(ctx context.Context) ([]types.IdCount, error) {
+	return h.counts(ctx, keywordsCollection, "k")
+}
+
+func (h *mongoHandle) counts(ctx context.Context, collection, root string) (kp []types.IdCount, err error) {
+	cur, err := h.FileDb.Collection(collection).Find(ctx,
+		bson.M{"value": bson.M{"$gt": 0}},
+		options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(ctx, &kp); err != nil {
+		return nil, err
+	}
+	for i := range kp {
+		kp[i].Root = root
+	}
+	return kp, nil
+}
+
+// The keyword and extension counts are kept up to date as files are created
+// and removed, in collections of {_id: value, value: count}, the same as the
+// "mongo" handler keeps them.
+const (
+	keywordsCollection   = "fs.keywords"
+	extensionsCollection = "fs.extensions"
+)
+
+// the pipelines to count up the files already stored, into each collection
+// unhidden matches the files that are counted, neither in the trash nor
+// earlier revisions, nor still being written
+var unhidden = bson.M{"metadata.deleted": bson.M{"$exists": false}, "metadata.superseded": bson.M{"$exists": false}, "$nor": unfinished}
+
+var countPipelines = map[string]mongo.Pipeline{
+	keywordsCollection: {
+		stage("$match", unhidden),
+		stage("$unwind", "$metadata.keywords"),
+		stage("$group", bson.M{"_id": "$metadata.keywords", "value": bson.M{"$sum": 1}}),
+		stage("$out", keywordsCollection),
+	},
+	extensionsCollection: {
+		stage("$match", unhidden),
+		stage("$match", bson.M{"filename": bson.M{"$exists": true, "$ne": ""}}),
+		stage("$project", bson.M{
+			// the last segment of the split
+			"ext": bson.M{"$arrayElemAt": bson.A{bson.M{"$split": bson.A{"$filename", "."}}, -1}},
+		}),
+		stage("$group", bson.M{"_id": "$ext", "value": bson.M{"$sum": 1}}),
+		stage("$out", extensionsCollection),
+	},
+}
+
+func stage(operator string, value interface{}) bson.D {
+	return bson.D{{Key: operator, Value: value}}
+}
+
+func extension(filename string) string {
+	s := strings.Split(filename, ".")
+	return s[len(s)-1] // get the last segment of the split
+}
+
+// Uploads of the same contents are stored once. fs.blobs has a
+// {_id: md5, files_id: id, refs: count} for each md5 that is shared, where
+// files_id is the file that owns the chunks, and the files that share them
+// have it as their blob. A file is only ever moved into the owner's document,
+// so that the others need not be changed. Without transactions, a crash or a
+// race part way through can leave a blob with a count too high, which only
+// keeps its chunks around; it never has them removed from under a file.
+const blobsCollection = "fs.blobs"
+
+type blob struct {
+	Md5     string      `bson:"_id"`
+	FilesId interface{} `bson:"files_id"`
+	Refs    int         `bson:"refs"`
+}
+
+// share has the file with id read the chunks already stored for its md5, and
+// drops its own, or else records its chunks as the ones for the md5. A file
+// that can not share keeps its chunks.
+func (h *mongoHandle) share(ctx context.Context, id interface{}, md5 string) error {
+	blobs := h.FileDb.Collection(blobsCollection)
+	var b blob
+	err := blobs.FindOne(ctx, bson.M{"_id": md5}).Decode(&b)
+	if err == mongo.ErrNoDocuments {
+		_, err = blobs.InsertOne(ctx, blob{Md5: md5, FilesId: id, Refs: 1})
+		if mongo.IsDuplicateKeyError(err) {
+			return nil // another upload of the same contents got there first
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	// the file points at the blob before it is counted, so that the owner can
+	// always find a file to hand over to, while the count is above one
+	if _, err := h.Files.UpdateByID(ctx, id, bson.M{"$set": bson.M{"blob": b.FilesId}}); err != nil {
+		return err
+	}
+	res, err := blobs.UpdateOne(ctx,
+		bson.M{"_id": md5, "files_id": b.FilesId, "refs": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"refs": 1}})
+	if err != nil || res.MatchedCount == 0 {
+		// the owner let go of the blob in the meantime, if there was no error
+		h.Files.UpdateByID(ctx, id, bson.M{"$unset": bson.M{"blob": 1}})
+		return err
+	}
+	_, err = h.Bucket.GetChunksCollection().DeleteMany(ctx, bson.M{"files_id": id})
+	return err
+}
+
+// removeFile removes the file document doc, and its chunks, unless other files
+// share them. Then one of those is moved into doc in its place, keeping the
+// chunks. The file already being removed is gridfs.ErrFileNotFound.
+func (h *mongoHandle) removeFile(ctx context.Context, doc revision) error {
+	blobs := h.FileDb.Collection(blobsCollection)
+	if doc.Blob != nil {
+		res, err := h.Files.DeleteOne(ctx, bson.M{"_id": doc.Id})
+		if err != nil {
+			return err
+		} else if res.DeletedCount == 0 {
+			return gridfs.ErrFileNotFound
+		}
+		_, err = blobs.UpdateOne(ctx,
+			bson.M{"_id": doc.Md5, "files_id": doc.Blob},
+			bson.M{"$inc": bson.M{"refs": -1}})
+		return err
+	}
+
+	var b blob
+	if err := blobs.FindOne(ctx, bson.M{"_id": doc.Md5, "files_id": doc.Id}).Decode(&b); err == mongo.ErrNoDocuments {
+		return h.Bucket.DeleteContext(ctx, doc.Id) // not shared
+	} else if err != nil {
+		return err
+	}
+	res, err := blobs.DeleteOne(ctx, bson.M{"_id": doc.Md5, "files_id": doc.Id, "refs": bson.M{"$lte": 1}})
+	if err != nil {
+		return err
+	} else if res.DeletedCount > 0 {
+		return h.Bucket.DeleteContext(ctx, doc.Id) // no longer shared
+	}
+
+	var owner, other bson.M
+	if err := h.Files.FindOne(ctx, bson.M{"_id": doc.Id}).Decode(&owner); err == mongo.ErrNoDocuments {
+		return gridfs.ErrFileNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := h.Files.FindOne(ctx, bson.M{"blob": doc.Id}).Decode(&other); err == mongo.ErrNoDocuments {
+		// counted, but not shared after all
+		if _, err := blobs.DeleteOne(ctx, bson.M{"_id": doc.Md5}); err != nil {
+			return err
+		}
+		return h.Bucket.DeleteContext(ctx, doc.Id)
+	} else if err != nil {
+		return err
+	}
+	if _, err := h.Files.DeleteOne(ctx, bson.M{"_id": other["_id"]}); err != nil {
+		return err
+	}
+	delete(other, "_id")
+	delete(other, "blob")
+	other["chunkSize"] = owner["chunkSize"]
+	if _, err := h.Files.ReplaceOne(ctx, bson.M{"_id": doc.Id}, other); err != nil {
+		return err
+	}
+	_, err = blobs.UpdateOne(ctx, bson.M{"_id": doc.Md5}, bson.M{"$inc": bson.M{"refs": -1}})
+	return err
+}
+
+// indexes are what the lookups and sorts on fs.files need. Filenames are
+// lowercased before they are stored, so the unique index on them is a
+// case-insensitive one. Expired files are found by metadata.expires, and not
+// left to a TTL index, which would remove them from fs.files but leave their
+// chunks behind. Random picks walk metadata.random, by keyword or not. The
+// files sharing a blob are found by it, when its owner is removed.
+var indexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "filename", Value: 1}, {Key: "metadata.superseded", Value: 1}}, Options: options.Index().SetUnique(true)},
+	{Keys: bson.D{{Key: "md5", Value: 1}}},
+	{Keys: bson.D{{Key: "metadata.keywords", Value: 1}, {Key: "metadata.timestamp", Value: -1}}},
+	{Keys: bson.D{{Key: "metadata.timestamp", Value: -1}}},
+	{Keys: bson.D{{Key: "metadata.renamed", Value: 1}}},
+	{Keys: bson.D{{Key: "metadata.expires", Value: 1}}, Options: options.Index().SetSparse(true)},
+	{Keys: bson.D{{Key: "metadata.random", Value: 1}}},
+	{Keys: bson.D{{Key: "metadata.keywords", Value: 1}, {Key: "metadata.random", Value: 1}}},
+	{Keys: bson.D{{Key: "blob", Value: 1}}, Options: options.Index().SetSparse(true)},
+}
+
+// ensureIndexes builds any of the indexes that are missing, logging how each
+// one went. A store that already has the same filename more than once, from
+// before the indexes, gets a plain index there instead of the unique one.
+func (h *mongoHandle) ensureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancel()
+
+	for _, index := range indexes {
+		unique := index.Options != nil && index.Options.Unique != nil && *index.Options.Unique
+		name, err := h.Files.Indexes().CreateOne(ctx, index)
+		if err != nil && unique && mongo.IsDuplicateKeyError(err) {
+			log.Printf("mongodb: %s has duplicate %v, indexing without the unique constraint: %s", h.Files.Name(), index.Keys, err)
+			unique = false
+			name, err = h.Files.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: index.Keys})
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("mongodb: %s index %s is ready (unique: %t)", h.Files.Name(), name, unique)
+	}
+	return nil
+}
+
+// initCounts counts up the keywords and extensions of the files already
+// stored, the first time the counts are needed
+func (h *mongoHandle) initCounts(ctx context.Context) error {
+	names, err := h.FileDb.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == keywordsCollection || name == extensionsCollection {
+			return nil
+		}
+	}
+	for name, pipeline := range countPipelines {
+		// so that an empty store is not counted up again
+		if err := h.FileDb.CreateCollection(ctx, name); err != nil {
+			return err
+		}
+		cur, err := h.Files.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		if err := cur.Close(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tally adds delta to the counts for the file's keywords and extension,
+// unless it is hidden
+func (h *mongoHandle) tally(ctx context.Context, f types.File, delta int) error {
+	if f.Metadata.Hidden() {
+		return nil
+	}
+	inc := bson.M{"$inc": bson.M{"value": delta}}
+	upsert := options.Update().SetUpsert(true)
+	for _, k := range f.Metadata.Keywords {
+		if _, err := h.FileDb.Collection(keywordsCollection).UpdateByID(ctx, k, inc, upsert); err != nil {
+			return err
+		}
+	}
+	if len(f.Filename) > 0 {
+		if _, err := h.FileDb.Collection(extensionsCollection).UpdateByID(ctx, extension(f.Filename), inc, upsert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadFile is a dbutil.File open for reading. A file read from the chunks
+// it shares has its own metadata, rather than the stream's.
+type downloadFile struct {
+	h    *mongoHandle
+	ctx  context.Context
+	ds   *gridfs.DownloadStream
+	info *types.Info
+
+	offset int64 // where the next Read is from
+	pos    int64 // where ds is up to
+}
+
+func (f *downloadFile) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := f.sync(); err != nil {
+		return 0, err
+	}
+	n, err := f.ds.Read(p)
+	f.offset += int64(n)
+	f.pos = f.offset
+	return n, err
+}
+
+// sync moves ds to the offset, if a Seek has moved it. A DownloadStream can
+// only Skip forward, so seeking backward opens the file again.
+func (f *downloadFile) sync() error {
+	if f.offset == f.pos {
+		return nil
+	}
+	if f.offset < f.pos {
+		ds, err := f.h.Bucket.OpenDownloadStream(f.ds.GetFile().ID)
+		if err != nil {
+			return err
+		}
+		if deadline, ok := f.ctx.Deadline(); ok {
+			if err := ds.SetReadDeadline(deadline); err != nil {
+				ds.Close()
+				return err
+			}
+		}
+		f.ds.Close()
+		f.ds, f.pos = ds, 0
+	}
+	n, err := f.ds.Skip(f.offset - f.pos)
+	f.pos += n
+	return err
+}
+
+func (f *downloadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.ds.GetFile().Length
+	default:
+		return f.offset, errors.New("mongodb: invalid whence")
+	}
+	if offset < 0 {
+		return f.offset, errors.New("mongodb: negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *downloadFile) Write(p []byte) (int, error) {
+	return 0, errNotWriting
+}
+
+func (f *downloadFile) Close() error {
+	return f.ds.Close()
+}
+
+func (f *downloadFile) GetMeta(result interface{}) error {
+	if f.info != nil {
+		buf, err := bson.Marshal(f.info)
+		if err != nil {
+			return err
+		}
+		return bson.Unmarshal(buf, result)
+	}
+	meta := f.ds.GetFile().Metadata
+	if len(meta) == 0 {
+		return nil
+	}
+	return bson.Unmarshal(meta, result)
+}
+
+func (f *downloadFile) SetMeta(metadata interface{}) {}
+
+// uploadFile is a dbutil.File open for writing. The upload stream is only
+// opened on the first Write (or Close), so that SetMeta can be called first.
+type uploadFile struct {
+	h          *mongoHandle
+	ctx        context.Context
+	filename   string
+	metadata   interface{}
+	uploadDate time.Time
+	replaces   string // filename to take over, once written
+	revises    string // filename to take over from the current revision, once written
+
+	us  *gridfs.UploadStream
+	sum hash.Hash
+	err error
+}
+
+func (f *uploadFile) open() error {
+	if f.us != nil || f.err != nil {
+		return f.err
+	}
+	if f.err = f.ctx.Err(); f.err != nil {
+		return f.err
+	}
+	opts := options.GridFSUpload()
+	if f.metadata != nil {
+		opts.SetMetadata(f.metadata)
+	}
+	f.us, f.err = f.h.Bucket.OpenUploadStream(f.filename, opts)
+	if f.err != nil {
+		return f.err
+	}
+	if deadline, ok := f.ctx.Deadline(); ok {
+		f.err = f.us.SetWriteDeadline(deadline)
+	}
+	return f.err
+}
+
+func (f *uploadFile) Read(p []byte) (int, error) {
+	return 0, errors.New("mongodb: file is open for writing")
+}
+
+func (f *uploadFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("mongodb: file is open for writing")
+}
+
+func (f *uploadFile) Write(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	if f.err = f.ctx.Err(); f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.us.Write(p)
+	f.sum.Write(p[:n])
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Close completes the upload, and adds the md5 that GridFS no longer does
+func (f *uploadFile) Close() error {
+	if err := f.open(); err != nil {
+		if f.us != nil {
+			f.us.Abort()
+		}
+		return err
+	}
+	if err := f.us.Close(); mongo.IsDuplicateKeyError(err) {
+		// the chunks are already written, and left behind by the driver
+		f.h.Bucket.GetChunksCollection().DeleteMany(context.Background(), bson.M{"files_id": f.us.FileID})
+		return dbutil.ErrExists
+	} else if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(f.sum.Sum(nil))
+	set := bson.M{"md5": sum}
+	if !f.uploadDate.IsZero() {
+		set["uploadDate"] = f.uploadDate
+	}
+	doc := types.File{Filename: f.filename}
+	var superseded []revision
+	if takes := f.replaces + f.revises; len(takes) > 0 {
+		var err error
+		if superseded, err = f.h.supersede(f.ctx, takes); err != nil {
+			f.abandon(superseded)
+			return err
+		}
+		set["filename"] = takes
+		doc.Filename = takes
+	}
+	if _, err := f.h.Files.UpdateOne(f.ctx, bson.M{"_id": f.us.FileID}, bson.M{"$set": set}); err != nil {
+		if doc.Filename != f.filename {
+			f.abandon(superseded)
+		}
+		return err
+	}
+	if len(f.replaces) > 0 {
+		// only now that the new file has the name are the ones it replaces
+		// removed, all of them being superseded and uncounted by now
+		filter := bson.M{"filename": f.replaces, "_id": bson.M{"$ne": f.us.FileID}}
+		if err := f.h.removeAll(f.ctx, filter); err != nil {
+			log.Printf("mongodb: [%s] keeps the files it replaced, as earlier revisions: %s", f.replaces, err)
+		}
+	}
+	if err := f.GetMeta(&doc.Metadata); err != nil {
+		return err
+	}
+	if err := f.h.tally(f.ctx, doc, 1); err != nil {
+		return err
+	}
+	if err := f.h.share(f.ctx, f.us.FileID, sum); err != nil {
+		log.Printf("mongodb: [%s] keeps its own chunks: %s", doc.Filename, err)
+	}
+	return nil
+}
+
+// abandon removes the file written under a name of its own, when it fails to
+// take its filename, and makes what it superseded current again. The ctx may
+// be why it failed, so it is done regardless.
+func (f *uploadFile) abandon(superseded []revision) {
+	ctx := context.Background()
+	f.h.unsupersede(ctx, superseded)
+	f.h.Bucket.DeleteContext(ctx, f.us.FileID)
+}
+
+func (f *uploadFile) SetUploadDate(t time.Time) {
+	f.uploadDate = t
+}
+
+func (f *uploadFile) GetMeta(result interface{}) error {
+	if f.metadata == nil {
+		return nil
+	}
+	buf, err := bson.Marshal(f.metadata)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(buf, result)
+}
+
+func (f *uploadFile) SetMeta(metadata interface{}) {
+	if f.us != nil {
+		// the metadata has already gone out with the upload stream
+		f.err = errNotWriting
+		return
+	}
+	f.metadata = metadata
+}
@@ -0,0 +1,35 @@
+package mongodb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil/dbutiltest"
+)
+
+// Set IMGSRV_TEST_MONGO to a mongo host seed (like "localhost") to run these.
+// In CI, where a mongo is run for them, they are not skipped.
+func TestConformance(t *testing.T) {
+	seed := os.Getenv("IMGSRV_TEST_MONGO")
+	if len(seed) == 0 {
+		if len(os.Getenv("CI")) > 0 {
+			t.Fatal("IMGSRV_TEST_MONGO is not set, and CI is")
+		}
+		t.Skip("IMGSRV_TEST_MONGO is not set")
+	}
+
+	h := &mongoHandle{}
+	if err := h.Init(json.Marshal(dbConfig{
+		Seed:   seed,
+		DbName: fmt.Sprintf("imgsrv_test_%d", time.Now().UnixNano()),
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	defer h.FileDb.Drop(context.Background())
+	dbutiltest.Run(t, h)
+}
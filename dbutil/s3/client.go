@@ -0,0 +1,232 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // sha256 of ""
+)
+
+// client is just enough of an S3 client, signing requests with AWS
+// Signature Version 4.
+type client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+
+	http *http.Client
+	now  func() time.Time
+}
+
+// statusError is a non-2xx response from the server
+type statusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+func isNotFound(err error) bool {
+	se, ok := err.(statusError)
+	return ok && se.StatusCode == http.StatusNotFound
+}
+
+// objectURL is the URL of key, with the bucket in either the path or the host
+func (c *client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return &u
+}
+
+func (c *client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := c.objectURL(key)
+	u.RawQuery = canonicalQuery(query) // escaped as it will be signed
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		c.sign(req, unsignedPayload)
+	} else {
+		c.sign(req, emptyPayload)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, statusError{StatusCode: resp.StatusCode, Body: string(buf)}
+	}
+	return resp, nil
+}
+
+func (c *client) putObject(ctx context.Context, key string, r io.Reader, size int64) error {
+	resp, err := c.do(ctx, "PUT", key, nil, nil, r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *client) getObject(ctx context.Context, key string, header http.Header) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "GET", key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *client) deleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, "DELETE", key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listObjects lists the keys starting with prefix, with ListObjectsV2, a page
+// at a time
+func (c *client) listObjects(ctx context.Context, prefix string) (keys []string, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := c.do(ctx, "GET", "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// sign adds the Authorization header for req, per
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (c *client) sign(req *http.Request, payloadHash string) {
+	t := c.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSha256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSha256(key, c.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(v url.Values) string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string{}, v[k]...)
+		sort.Strings(vals)
+		for _, val := range vals {
+			parts = append(parts, escape(k)+"="+escape(val))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape is url.QueryEscape, but with spaces as %20 as AWS expects
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hexSha256(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
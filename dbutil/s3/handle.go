@@ -0,0 +1,131 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/dbutil/blobstore"
+)
+
+func init() {
+	dbutil.Handles["s3"] = &s3Handle{}
+}
+
+const (
+	defaultRegion = "us-east-1"
+	indexKey      = "index.json" // metadata for all the stored files
+	blobsPrefix   = "blobs"      // file bodies, keyed by their entry Id
+)
+
+type dbConfig struct {
+	Endpoint  string // e.g. "http://localhost:9000" for a local MinIO
+	Bucket    string // bucket to store everything in. It must already exist.
+	Region    string // defaults to "us-east-1"
+	AccessKey string
+	SecretKey string
+	PathStyle bool // address the bucket as endpoint/bucket, rather than bucket.endpoint
+}
+
+type s3Handle struct {
+	blobstore.Handle
+	config dbConfig
+}
+
+func (h *s3Handle) Init(config []byte, err error) error {
+	if err != nil {
+		return err
+	}
+
+	h.config = dbConfig{}
+	if err := json.Unmarshal(config, &h.config); err != nil {
+		return err
+	}
+	if len(h.config.Endpoint) == 0 || len(h.config.Bucket) == 0 {
+		return errors.New("s3: an endpoint and bucket are required")
+	}
+	endpoint, err := url.Parse(h.config.Endpoint)
+	if err != nil {
+		return err
+	}
+	if len(h.config.Region) == 0 {
+		h.config.Region = defaultRegion
+	}
+
+	return h.Setup(&bucketBackend{
+		client: &client{
+			endpoint:  endpoint,
+			bucket:    h.config.Bucket,
+			region:    h.config.Region,
+			accessKey: h.config.AccessKey,
+			secretKey: h.config.SecretKey,
+			pathStyle: h.config.PathStyle,
+			http:      &http.Client{},
+			now:       time.Now,
+		},
+	})
+}
+
+// bucketBackend keeps the blobs and index as objects in the bucket
+type bucketBackend struct {
+	client *client
+}
+
+func (b *bucketBackend) key(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (b *bucketBackend) Put(ctx context.Context, id string, r io.Reader, size int64) error {
+	return b.client.putObject(ctx, b.key(blobsPrefix, id), r, size)
+}
+
+func (b *bucketBackend) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	return b.client.getObject(ctx, b.key(blobsPrefix, id), nil)
+}
+
+func (b *bucketBackend) GetRange(ctx context.Context, id string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	return b.client.getObject(ctx, b.key(blobsPrefix, id), header)
+}
+
+func (b *bucketBackend) Delete(ctx context.Context, id string) error {
+	return b.client.deleteObject(ctx, b.key(blobsPrefix, id))
+}
+
+func (b *bucketBackend) List(ctx context.Context) ([]string, error) {
+	keys, err := b.client.listObjects(ctx, blobsPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = strings.TrimPrefix(key, blobsPrefix+"/")
+	}
+	return ids, nil
+}
+
+func (b *bucketBackend) LoadIndex() ([]byte, error) {
+	rc, err := b.client.getObject(context.Background(), b.key(indexKey), nil)
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func (b *bucketBackend) SaveIndex(buf []byte) error {
+	return b.client.putObject(context.Background(), b.key(indexKey), bytes.NewReader(buf), int64(len(buf)))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/vbatts/imgsrv/config"
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/types"
+)
+
+/*
+imgsrv [flags] fsck [-quarantine]
+
+Read back every stored file, and each of its earlier revisions, and check the
+md5 and length of what comes back against those recorded when it was stored.
+Missing or truncated contents fail the same way. DbHandlers that are
+dbutil.Scrubbers are also asked for their orphans, like GridFS chunks without
+a file, which are only reported.
+
+With -quarantine, a file whose current revision fails is put in the trash,
+out of the listings, until it is restored or purged. The server runs the same
+checks every -scrub-interval.
+*/
+func runFsck(c *config.Config, args []string) error {
+	var quarantine bool
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fs.BoolVar(&quarantine, "quarantine", c.Quarantine, "Put the files that fail the check in the trash")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	h, err := openHandler(c, c.DbHandler)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	r, err := scrub(context.Background(), h, quarantine)
+	if err != nil {
+		return err
+	}
+	if r.corrupt > 0 || r.orphans > 0 {
+		return fmt.Errorf("fsck: %d corrupt revisions, %d orphans", r.corrupt, r.orphans)
+	}
+	return nil
+}
+
+// scrubReport is the tally of a scrub
+type scrubReport struct {
+	checked, corrupt, quarantined, orphans int
+}
+
+func (r scrubReport) String() string {
+	return fmt.Sprintf("%d revisions checked, %d corrupt, %d quarantined, %d orphans",
+		r.checked, r.corrupt, r.quarantined, r.orphans)
+}
+
+/*
+scrub checks every revision of every file h stores, including the trash,
+logging each one that fails, and then looks for orphans. With quarantine, the
+files whose current revision fails are put in the trash. Failing to look for
+orphans fails the scrub, as a store that could not be checked is not a clean
+one.
+*/
+func scrub(ctx context.Context, h dbutil.Handler, quarantine bool) (r scrubReport, err error) {
+	files, err := h.GetFiles(ctx, dbutil.Page{})
+	if err != nil {
+		return r, err
+	}
+	trash, err := h.GetTrash(ctx, dbutil.Page{})
+	if err != nil {
+		return r, err
+	}
+	files = append(files, trash...)
+
+	seen := map[string]bool{}
+	for _, file := range files {
+		if seen[file.Filename] {
+			continue
+		}
+		seen[file.Filename] = true
+
+		revisions, err := h.GetRevisions(ctx, file.Filename)
+		if err == dbutil.ErrNotFound {
+			continue // removed since the listing
+		} else if err != nil {
+			return r, err
+		}
+		for i, rev := range revisions {
+			r.checked++
+			err := checkRevision(ctx, h, rev, i+1)
+			if err == nil {
+				continue
+			} else if ctx.Err() != nil {
+				return r, ctx.Err()
+			}
+			r.corrupt++
+			log.Printf("scrub: [%s] revision %d: %s", rev.Filename, i+1, err)
+
+			if !quarantine || i < len(revisions)-1 || rev.Metadata.IsDeleted() {
+				continue
+			}
+			info := rev.Metadata
+			info.Trash("scrub", time.Now())
+			if err := h.UpdateInfo(ctx, rev.Filename, info); err != nil {
+				return r, err
+			}
+			log.Printf("scrub: [%s] quarantined in the trash", rev.Filename)
+			r.quarantined++
+		}
+	}
+
+	if s, ok := h.(dbutil.Scrubber); ok {
+		ids, err := s.Orphans(ctx)
+		if err != nil {
+			return r, fmt.Errorf("looking for orphans: %s", err)
+		}
+		for _, id := range ids {
+			log.Printf("scrub: orphan %s", id)
+		}
+		r.orphans = len(ids)
+	}
+	log.Printf("scrub: %s", r)
+	return r, nil
+}
+
+// checkRevision reads back revision n of file, for its md5 and length
+func checkRevision(ctx context.Context, h dbutil.Handler, file types.File, n int) error {
+	f, err := h.OpenRevision(ctx, file.Filename, n)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum := md5.New()
+	length, err := io.Copy(sum, f)
+	if err != nil {
+		return err
+	}
+	if read := hex.EncodeToString(sum.Sum(nil)); read != file.Md5 {
+		return fmt.Errorf("read md5 %s (%d bytes), but %s (%d bytes) was stored", read, length, file.Md5, file.Length)
+	}
+	if uint64(length) != file.Length {
+		return fmt.Errorf("read %d bytes, but %d were stored", length, file.Length)
+	}
+	return nil
+}
@@ -5,6 +5,12 @@ package main
  * can be an image server, that stores into a mongo backend,
  OR
  * the client side tool that pushes/pulls images to the running server.
+ OR
+ * `imgsrv migrate`, to copy all the files between two backends.
+ OR
+ * `imgsrv fsck`, to check that the stored files are intact.
+ OR
+ * `imgsrv export` and `imgsrv import`, to back the files up to a tar archive.
 */
 
 import (
@@ -27,25 +33,30 @@ var (
 		Ip:            "0.0.0.0",
 		Port:          "7777",
 		DbHandler:     "mongo",
+		DataDir:       "",
 		MongoHost:     "localhost",
 		MongoDbName:   "filesrv",
 		MongoUsername: "",
 		MongoPassword: "",
+		S3Endpoint:    "",
+		S3Bucket:      "",
+		S3Region:      "",
+		S3AccessKey:   "",
+		S3SecretKey:   "",
+		S3PathStyle:   false,
 		RemoteHost:    "",
 	}
 
 	PutFile      = ""
 	FetchUrl     = ""
 	FileKeywords = ""
+	FileExpires  = ""
+	RenameFile   = ""
+	RenameTo     = ""
 )
 
 func main() {
 	flag.Parse()
-	for _, arg := range flag.Args() {
-		// TODO What to do with these floating args ...
-		//      Assume they're files and upload them?
-		log.Printf("%s", arg)
-	}
 
 	// loads either default or flag specified config
 	// to override variables
@@ -53,7 +64,35 @@ func main() {
 		DefaultConfig.Merge(c)
 	}
 
-	if DefaultConfig.Server {
+	if flag.NArg() > 0 && flag.Arg(0) == "migrate" {
+		// copy everything from one backend to another
+
+		if err := runMigrate(DefaultConfig, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+
+	} else if flag.NArg() > 0 && flag.Arg(0) == "fsck" {
+		// check every stored file against its md5 and length
+
+		if err := runFsck(DefaultConfig, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+
+	} else if flag.NArg() > 0 && flag.Arg(0) == "export" {
+		// back up the files to a tar archive
+
+		if err := runExport(DefaultConfig, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+
+	} else if flag.NArg() > 0 && flag.Arg(0) == "import" {
+		// restore the files from a tar archive
+
+		if err := runImport(DefaultConfig, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+
+	} else if DefaultConfig.Server {
 		// Run the server!
 
 		runServer(DefaultConfig)
@@ -68,9 +107,33 @@ func main() {
 		}
 		log.Println(file)
 
+	} else if len(RenameFile) > 0 {
+		// moving a file on the remote server to a new name
+
+		if len(DefaultConfig.RemoteHost) == 0 {
+			log.Println("Please provide a remotehost!")
+			return
+		}
+		if len(RenameTo) == 0 {
+			log.Println("Please provide the new name, with -to!")
+			return
+		}
+		url_path, err := client.RenameFile(DefaultConfig.RemoteHost, RenameFile, RenameTo)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		fmt.Printf("%s%s\n", DefaultConfig.RemoteHost, url_path)
+
 	} else {
 		// we're pushing up a file
 
+		for _, arg := range flag.Args() {
+			// TODO What to do with these floating args ...
+			//      Assume they're files and upload them?
+			log.Printf("%s", arg)
+		}
+
 		if len(DefaultConfig.RemoteHost) == 0 {
 			log.Println("Please provide a remotehost!")
 			return
@@ -85,6 +148,9 @@ func main() {
 		} else {
 			log.Println("WARN: you didn't provide any keywords :-(")
 		}
+		if len(FileExpires) > 0 {
+			params["expires"] = FileExpires
+		}
 		url, err := url.Parse(DefaultConfig.RemoteHost + "/f/")
 		if err != nil {
 			log.Println(err)
@@ -130,11 +196,17 @@ func init() {
 		DefaultConfig.DbHandler,
 		"Database backend handler (if runnint as a server)")
 
+	/* fs and bolt settings */
+	flag.StringVar(&DefaultConfig.DataDir,
+		"data-dir",
+		DefaultConfig.DataDir,
+		"Directory to store files in, with '-dbhandler fs' or 'bolt' ('datadir' in the config)")
+
 	/* MongoDB settings */
 	flag.StringVar(&DefaultConfig.MongoHost,
 		"mongo-host",
 		DefaultConfig.MongoHost,
-		"Mongo Host to connect to ('mongohost' in the config)")
+		"Mongo Host, or mongodb:// URI, to connect to ('mongohost' in the config)")
 	flag.StringVar(&DefaultConfig.MongoDbName,
 		"mongo-db",
 		DefaultConfig.MongoDbName,
@@ -148,6 +220,49 @@ func init() {
 		DefaultConfig.MongoPassword,
 		"Mongo password to auth with (if needed) ('mongopassword' in the config)")
 
+	/* S3 settings */
+	flag.StringVar(&DefaultConfig.S3Endpoint,
+		"s3-endpoint",
+		DefaultConfig.S3Endpoint,
+		"S3 endpoint URL, with '-dbhandler s3' ('s3endpoint' in the config)")
+	flag.StringVar(&DefaultConfig.S3Bucket,
+		"s3-bucket",
+		DefaultConfig.S3Bucket,
+		"S3 bucket to store files in, with an index of them all that is rewritten on every change ('s3bucket' in the config)")
+	flag.StringVar(&DefaultConfig.S3Region,
+		"s3-region",
+		DefaultConfig.S3Region,
+		"S3 region, if not us-east-1 ('s3region' in the config)")
+	flag.StringVar(&DefaultConfig.S3AccessKey,
+		"s3-access-key",
+		DefaultConfig.S3AccessKey,
+		"S3 access key ('s3accesskey' in the config)")
+	flag.StringVar(&DefaultConfig.S3SecretKey,
+		"s3-secret-key",
+		DefaultConfig.S3SecretKey,
+		"S3 secret key ('s3secretkey' in the config)")
+	flag.BoolVar(&DefaultConfig.S3PathStyle,
+		"s3-path-style",
+		DefaultConfig.S3PathStyle,
+		"Use path-style bucket addressing, as MinIO expects ('s3pathstyle' in the config)")
+
+	flag.StringVar(&DefaultConfig.TrashRetention,
+		"trash-retention",
+		DefaultConfig.TrashRetention,
+		"How long deleted files are kept in the trash, like '720h' (the default) ('trashretention' in the config)")
+	flag.BoolVar(&DefaultConfig.Versioned,
+		"versioned",
+		DefaultConfig.Versioned,
+		"Keep the earlier revisions of a file uploaded again under the same name ('versioned' in the config)")
+	flag.StringVar(&DefaultConfig.ScrubInterval,
+		"scrub-interval",
+		DefaultConfig.ScrubInterval,
+		"Check every stored file against its md5 and length this often, like '168h' ('scrubinterval' in the config)")
+	flag.BoolVar(&DefaultConfig.Quarantine,
+		"quarantine",
+		DefaultConfig.Quarantine,
+		"Put the files that fail a scrub or fsck in the trash ('quarantine' in the config)")
+
 	/* Client-side */
 	flag.StringVar(&FetchUrl,
 		"fetch",
@@ -166,5 +281,17 @@ func init() {
 		"keywords",
 		FileKeywords,
 		"Keywords to associate with file. (comma delimited) (needs -put)")
+	flag.StringVar(&FileExpires,
+		"expires",
+		FileExpires,
+		"Have the file expire after this long, like '24h' (needs -put)")
+	flag.StringVar(&RenameFile,
+		"rename",
+		RenameFile,
+		"Rename this file on the remote server (needs -remotehost and -to)")
+	flag.StringVar(&RenameTo,
+		"to",
+		RenameTo,
+		"New name for the file (needs -rename)")
 
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"strings"
 	"text/template"
 
 	humanize "github.com/dustin/go-humanize"
@@ -52,6 +53,7 @@ var navbarTemplateHTML = `
               <li><a href="/k/">Keywords</a></li>
               <li><a href="/ext/">File ext</a></li>
               <li><a href="/md5/">MD5s</a></li>
+              <li><a href="/trash">Trash</a></li>
             </ul>
           </div> <!-- dropdown -->
         </div> <!-- nav-collapse -->
@@ -97,6 +99,8 @@ var formDeleteFileTemplateHTML = `
 <a role="button" href="/v/{{.}}">no!</a>
 <br/>
 <a role="button" href="/f/{{.}}?delete=true&confirm=true">yes! delete!</a>
+<br/>
+(it can be restored from the <a href="/trash">trash</a>, for a while)
 </td>
 </tr>
 </table>
@@ -120,7 +124,14 @@ var formGetUrlTemplateHTML = `
   <td>
       <input type="text" name="url" placeholder="file URL"><br/>
       <input type="text" name="keywords" placeholder="keywords"><i>(comma seperatated, no spaces)</i><br/>
-      <input type="checkbox" name="rand" value="true">Randomize filename
+      <input type="checkbox" name="rand" value="true">Randomize filename<br/>
+      <input type="checkbox" name="dedup" value="true">Use the existing file, if it's already here<br/>
+      <select name="expires">
+        <option value="">Keep it</option>
+        <option value="1h">Expire in an hour</option>
+        <option value="24h">Expire in a day</option>
+        <option value="168h">Expire in a week</option>
+      </select><br/>
   </td>
     </tr>
     <tr>
@@ -146,7 +157,14 @@ var formFileUploadTemplateHTML = `
   <td>
       <input type="file" name="filename" placeholder="filename"><br/>
       <input type="text" name="keywords" placeholder="keywords"><i>(comma seperatated, no spaces)</i><br/>
-      <input type="checkbox" name="rand" value="true">Randomize filename
+      <input type="checkbox" name="rand" value="true">Randomize filename<br/>
+      <input type="checkbox" name="dedup" value="true">Use the existing file, if it's already here<br/>
+      <select name="expires">
+        <option value="">Keep it</option>
+        <option value="1h">Expire in an hour</option>
+        <option value="24h">Expire in a day</option>
+        <option value="168h">Expire in a week</option>
+      </select><br/>
   </td>
     </tr>
     <tr>
@@ -175,6 +193,64 @@ var listTemplateHTML = `
 {{end}}
 `
 
+var trashTemplate = template.Must(template.New("trash").Funcs(funcs).Parse(trashTemplateHTML))
+var trashTemplateHTML = `
+{{if .}}
+<form action="/trash" method="post">
+<table class="table">
+<tr><th>file</th><th>size</th><th>deleted</th><th>by</th><th></th></tr>
+{{range .}}
+<tr>
+  <td>{{.Filename}}</td>
+  <td>{{humanBytes .Length}}</td>
+  <td>{{.Metadata.Deleted}} ({{humanTime .Metadata.Deleted}})</td>
+  <td>{{.Metadata.DeletedBy}}</td>
+  <td>
+    <button type="submit" class="btn" name="restore" value="{{.Filename}}">Restore</button>
+    <button type="submit" class="btn btn-danger" name="purge" value="{{.Filename}}">Purge</button>
+  </td>
+</tr>
+{{end}}
+</table>
+</form>
+{{else}}
+<p>The trash is empty.</p>
+{{end}}
+`
+
+var revisionsTemplate = template.Must(template.New("revisions").Funcs(funcs).Parse(revisionsTemplateHTML))
+var revisionsTemplateHTML = `
+<h4>Revisions</h4>
+<table class="table">
+<tr><th></th><th>uploaded</th><th>md5</th><th>size</th><th>by</th></tr>
+{{range $i, $rev := .}}
+<tr>
+  <td><a href="/f/{{$rev.Filename}}?v={{inc $i}}">v{{inc $i}}</a></td>
+  <td>{{$rev.UploadDate}} ({{humanTime $rev.UploadDate}})</td>
+  <td><a href="/md5/{{$rev.Md5}}">{{$rev.Md5}}</a></td>
+  <td>{{humanBytes $rev.Length}}</td>
+  <td>{{$rev.Metadata.Ip}}</td>
+</tr>
+{{end}}
+</table>
+`
+
+// pager links to the pages either side of a listing, if there are any
+type pager struct {
+	Prev string
+	Next string
+}
+
+var pagerTemplate = template.Must(template.New("pager").Parse(pagerTemplateHTML))
+var pagerTemplateHTML = `
+{{if or .Prev .Next}}
+<ul class="pager">
+{{if .Prev}}<li class="previous"><a href="{{.Prev}}">&larr; Newer</a></li>{{end}}
+{{if .Next}}<li class="next"><a href="{{.Next}}">Older &rarr;</a></li>{{end}}
+</ul>
+{{end}}
+`
+
 var tagcloudTemplate = template.Must(template.New("tagcloud").Parse(tagcloudTemplateHTML))
 var tagcloudTemplateHTML = `
 {{if .}}
@@ -238,6 +314,8 @@ var fileViewTemplateHTML = `
 var funcs = template.FuncMap{
 	"humanBytes": humanize.Bytes,
 	"humanTime":  humanize.Time,
+	"join":       strings.Join,
+	"inc":        func(i int) int { return i + 1 },
 }
 
 var fileViewInfoTemplate = template.Must(template.New("file").Funcs(funcs).Parse(fileViewInfoTemplateHTML))
@@ -252,7 +330,15 @@ var fileViewInfoTemplateHTML = `
 <br/>
 [UploadDate: {{.Metadata.TimeStamp}} ({{humanTime .Metadata.TimeStamp}})]
 <br/>
-[<a href="/f/{{.Filename}}?delete=true">Delete</a>]
+{{if not .Metadata.Modified.IsZero}}[Modified: {{.Metadata.Modified}} ({{humanTime .Metadata.Modified}})]
+<br/>
+{{end}}{{if not .Metadata.Expires.IsZero}}[Expires: {{.Metadata.Expires}} ({{humanTime .Metadata.Expires}})]
+<br/>
+{{end}}[<a href="/f/{{.Filename}}?delete=true">Delete</a>]
+<form action="/v/{{.Filename}}" method="post" class="form-inline">
+  <input type="text" name="keywords" value="{{join .Metadata.Keywords ","}}" placeholder="keywords, comma separated"/>
+  <input type="submit" class="btn" value="Save keywords"/>
+</form>
 {{end}}
 `
 
@@ -333,7 +419,7 @@ func UploadPage(w io.Writer) (err error) {
 	return
 }
 
-func ImageViewPage(w io.Writer, file types.File) (err error) {
+func ImageViewPage(w io.Writer, file types.File, revisions []types.File) (err error) {
 	err = headTemplate.Execute(w, map[string]string{"title": "FileSrv"})
 	if err != nil {
 		return err
@@ -363,6 +449,12 @@ func ImageViewPage(w io.Writer, file types.File) (err error) {
 	if err != nil {
 		return err
 	}
+	if len(revisions) > 1 {
+		err = revisionsTemplate.Execute(w, revisions)
+		if err != nil {
+			return err
+		}
+	}
 
 	err = tailTemplate.Execute(w, map[string]string{"footer": fmt.Sprintf("Version: %s", VERSION)})
 	if err != nil {
@@ -371,7 +463,7 @@ func ImageViewPage(w io.Writer, file types.File) (err error) {
 	return
 }
 
-func ListFilesPage(w io.Writer, files []types.File) (err error) {
+func ListFilesPage(w io.Writer, files []types.File, p pager) (err error) {
 	err = headTemplate.Execute(w, map[string]string{"title": "FileSrv"})
 	if err != nil {
 		return err
@@ -390,6 +482,41 @@ func ListFilesPage(w io.Writer, files []types.File) (err error) {
 	if err != nil {
 		return err
 	}
+	err = pagerTemplate.Execute(w, p)
+	if err != nil {
+		return err
+	}
+
+	err = tailTemplate.Execute(w, map[string]string{"footer": fmt.Sprintf("Version: %s", VERSION)})
+	if err != nil {
+		return err
+	}
+	return
+}
+
+func ListTrashPage(w io.Writer, files []types.File, p pager) (err error) {
+	err = headTemplate.Execute(w, map[string]string{"title": "FileSrv :: trash"})
+	if err != nil {
+		return err
+	}
+	err = navbarTemplate.Execute(w, nil)
+	if err != nil {
+		return err
+	}
+	err = containerBeginTemplate.Execute(w, nil)
+	if err != nil {
+		return err
+	}
+
+	// main context of this page
+	err = trashTemplate.Execute(w, files)
+	if err != nil {
+		return err
+	}
+	err = pagerTemplate.Execute(w, p)
+	if err != nil {
+		return err
+	}
 
 	err = tailTemplate.Execute(w, map[string]string{"footer": fmt.Sprintf("Version: %s", VERSION)})
 	if err != nil {
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/vbatts/imgsrv/config"
+	"github.com/vbatts/imgsrv/dbutil"
+	"github.com/vbatts/imgsrv/types"
+)
+
+/*
+imgsrv [flags] migrate -from mongo -to fs
+
+Copy every file, with all of its revisions and their metadata, from one
+DbHandler to another. Both are configured from the usual flags and config
+file. Revisions already present on the destination, by name and md5, are
+skipped, so an interrupted migration can just be run again. Upload dates are
+not compared, as not every DbHandler keeps them to the same precision, nor
+are the copies made by import given the original ones.
+*/
+func runMigrate(c *config.Config, args []string) error {
+	var (
+		from   string
+		to     string
+		verify bool
+	)
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.StringVar(&from, "from", c.DbHandler, "DbHandler to copy files from")
+	fs.StringVar(&to, "to", "", "DbHandler to copy files to")
+	fs.BoolVar(&verify, "verify", true, "Check the md5 and length of each file once it is copied")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(to) == 0 {
+		return errors.New("migrate: please provide a -to DbHandler")
+	}
+	if from == to {
+		return fmt.Errorf("migrate: -from and -to are both %q", from)
+	}
+
+	src, err := openHandler(c, from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openHandler(c, to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	ctx := context.Background()
+	files, err := src.GetFiles(ctx, dbutil.Page{})
+	if err != nil {
+		return err
+	}
+	trash, err := src.GetTrash(ctx, dbutil.Page{})
+	if err != nil {
+		return err
+	}
+	var (
+		names                   []string
+		seen                    = map[string]bool{}
+		copied, skipped, failed int
+	)
+	for _, file := range append(files, trash...) {
+		if !seen[file.Filename] {
+			seen[file.Filename] = true
+			names = append(names, file.Filename)
+		}
+	}
+
+	for i, name := range names {
+		revisions, err := src.GetRevisions(ctx, name)
+		if err != nil {
+			return err
+		}
+		sums := map[string]int{}
+		for n, file := range revisions {
+			progress := fmt.Sprintf("[%d/%d] %s", i+1, len(names), name)
+			if len(revisions) > 1 {
+				progress += fmt.Sprintf(" (revision %d of %d)", n+1, len(revisions))
+			}
+
+			sums[file.Md5]++
+			exists, err := hasCopy(ctx, dst, file, sums[file.Md5])
+			if err != nil {
+				return err
+			}
+			if exists {
+				log.Printf("%s: already present", progress)
+				skipped++
+				continue
+			}
+
+			if err := migrateFile(ctx, src, dst, file, n+1, verify); err != nil {
+				log.Printf("%s: FAILED: %s", progress, err)
+				failed++
+				continue
+			}
+			log.Printf("%s: copied %d bytes", progress, file.Length)
+			copied++
+		}
+	}
+
+	log.Printf("migrate: %d copied, %d skipped, %d failed", copied, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("migrate: %d files failed to copy", failed)
+	}
+	return nil
+}
+
+// hasCopy checks whether dst already has the revision file, by name and md5.
+// It being the nth revision of its name with that md5, as when a file is
+// changed back to what it was, dst has to have as many.
+func hasCopy(ctx context.Context, dst dbutil.Handler, file types.File, nth int) (bool, error) {
+	revisions, err := dst.GetRevisions(ctx, file.Filename)
+	if err == dbutil.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, rev := range revisions {
+		if rev.Md5 == file.Md5 {
+			nth--
+		}
+	}
+	return nth <= 0, nil
+}
+
+// migrateFile streams revision n of file and its metadata from src to dst. An
+// earlier revision is stored alongside the ones dst has, and a current one as
+// a new revision of them. A copy that fails is removed again, leaving what dst
+// had before as it was.
+func migrateFile(ctx context.Context, src, dst dbutil.Handler, file types.File, n int, verify bool) (err error) {
+	before, err := dst.GetRevisions(ctx, file.Filename)
+	if err != nil && err != dbutil.ErrNotFound {
+		return err
+	}
+	in, err := src.OpenRevision(ctx, file.Filename, n)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var info types.Info
+	if err := in.GetMeta(&info); err != nil {
+		return err
+	}
+
+	create := dst.Create
+	if len(before) > 0 && !info.IsSuperseded() {
+		create = dst.CreateRevision
+	}
+	out, err := create(ctx, file.Filename)
+	if err != nil {
+		return err
+	}
+	out.SetMeta(&info)
+	if uds, ok := out.(dbutil.UploadDateSetter); ok {
+		uds.SetUploadDate(file.UploadDate)
+	}
+
+	sum := md5.New()
+	length, err := io.Copy(out, io.TeeReader(in, sum))
+	if err != nil {
+		out.Close()
+		removeWritten(ctx, dst, file.Filename, before)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if !verify {
+		return nil
+	}
+
+	read := hex.EncodeToString(sum.Sum(nil))
+	k, copied, err := written(ctx, dst, file.Filename, before)
+	if err == nil {
+		switch {
+		case k == 0:
+			err = errors.New("the copy is not there")
+		case read != file.Md5:
+			err = fmt.Errorf("read md5 %s, but the source has %s", read, file.Md5)
+		case copied.Md5 != file.Md5:
+			err = fmt.Errorf("copied md5 %s, but the source has %s", copied.Md5, file.Md5)
+		case uint64(length) != file.Length || copied.Length != file.Length:
+			err = fmt.Errorf("copied %d bytes, but the source has %d", copied.Length, file.Length)
+		}
+	}
+	if err != nil && k > 0 {
+		dst.RemoveRevision(ctx, file.Filename, k)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbatts/imgsrv/config"
+	"github.com/vbatts/imgsrv/dbutil"
+	_ "github.com/vbatts/imgsrv/dbutil/bolt"
+	"github.com/vbatts/imgsrv/types"
+)
+
+func TestMigrateRevisions(t *testing.T) {
+	ctx := context.Background()
+	src := dbutil.Handles["memory"]
+	if err := src.Init(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	dst := dbutil.Handles["bolt"]
+	if err := dst.Init(json.Marshal(struct{ Path string }{filepath.Join(t.TempDir(), "imgsrv.db")})); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	for i, contents := range []string{"first", "second"} {
+		create := src.Create
+		if i > 0 {
+			create = src.CreateRevision
+		}
+		f, err := create(ctx, "revised.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.SetMeta(&types.Info{Keywords: []string{contents}, TimeStamp: time.Now()})
+		io.WriteString(f, contents)
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revisions, err := src.GetRevisions(ctx, "revised.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, file := range revisions {
+		if err := migrateFile(ctx, src, dst, file, n+1, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copies, err := dst.GetRevisions(ctx, "revised.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copies) != 2 {
+		t.Fatalf("%d revisions copied, expected 2", len(copies))
+	}
+	for i, file := range revisions {
+		if copies[i].Md5 != file.Md5 || copies[i].Metadata.IsSuperseded() != file.Metadata.IsSuperseded() {
+			t.Errorf("revision %d copied as %#v, from %#v", i+1, copies[i], file)
+		}
+		if ok, err := hasCopy(ctx, dst, file, 1); !ok || err != nil {
+			t.Errorf("hasCopy of revision %d = %v, %v", i+1, ok, err)
+		}
+	}
+
+	// a copy that fails to verify is removed, and only that
+	corrupt := revisions[1]
+	corrupt.Md5 = "00000000000000000000000000000000"
+	corrupt.UploadDate = corrupt.UploadDate.Add(time.Minute)
+	if err := migrateFile(ctx, src, dst, corrupt, 2, true); err == nil {
+		t.Error("migrateFile of a corrupt revision succeeded")
+	}
+	if copies, err = dst.GetRevisions(ctx, "revised.png"); err != nil {
+		t.Fatal(err)
+	} else if len(copies) != 2 || copies[1].Md5 != revisions[1].Md5 || copies[1].Metadata.IsSuperseded() {
+		t.Errorf("after the failed copy, the revisions are %#v", copies)
+	}
+}
+
+func TestMigrateTwice(t *testing.T) {
+	ctx := context.Background()
+	c := &config.Config{DataDir: t.TempDir()}
+	src, err := openHandler(c, "fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changed back to what it was, so two of the revisions have the same md5
+	for i, contents := range []string{"first", "second", "first"} {
+		create := src.Create
+		if i > 0 {
+			create = src.CreateRevision
+		}
+		f, err := create(ctx, "revised.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.SetMeta(&types.Info{TimeStamp: time.Now()})
+		io.WriteString(f, contents)
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.Close()
+
+	for run := 1; run <= 2; run++ {
+		if err := runMigrate(c, []string{"-from", "fs", "-to", "bolt"}); err != nil {
+			t.Fatalf("migrate run %d: %s", run, err)
+		}
+		dst, err := openHandler(c, "bolt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		copies, err := dst.GetRevisions(ctx, "revised.png")
+		dst.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(copies) != 3 {
+			t.Errorf("migrate run %d left %d revisions, expected 3", run, len(copies))
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,7 +20,12 @@ import (
 	"github.com/vbatts/imgsrv/assets"
 	"github.com/vbatts/imgsrv/config"
 	"github.com/vbatts/imgsrv/dbutil"
+	_ "github.com/vbatts/imgsrv/dbutil/bolt"
+	_ "github.com/vbatts/imgsrv/dbutil/fs"
+	_ "github.com/vbatts/imgsrv/dbutil/memory"
 	_ "github.com/vbatts/imgsrv/dbutil/mongo"
+	_ "github.com/vbatts/imgsrv/dbutil/mongodb"
+	_ "github.com/vbatts/imgsrv/dbutil/s3"
 	"github.com/vbatts/imgsrv/hash"
 	"github.com/vbatts/imgsrv/types"
 	"github.com/vbatts/imgsrv/util"
@@ -24,58 +33,127 @@ import (
 
 var (
 	defaultPageLimit int   = 25
+	maxRenames       int   = 5 // fresh names to try for an upload whose name is taken
 	maxBytes         int64 = 1024 * 512
 	serverConfig     config.Config
 	du               dbutil.Handler
+
+	defaultTrashRetention = 30 * 24 * time.Hour // how long deleted files are kept, unless configured
+	trashPurgeInterval    = time.Hour           // how often the trash is checked for files to purge
+	expiryInterval        = time.Minute         // how often expired files are looked for, to remove
 )
 
 // Run as the file/image server
 func runServer(c *config.Config) {
 	serverConfig = *c
 
-	var duConfig interface{}
-	var ok bool
-	if du, ok = dbutil.Handles[serverConfig.DbHandler]; !ok {
-		log.Fatalf("DbHandler %q not found", serverConfig.DbHandler)
+	var err error
+	if du, err = openHandler(&serverConfig, serverConfig.DbHandler); err != nil {
+		log.Fatal(err)
+	}
+	defer du.Close() // TODO this ought to catch a signal to cleanup
+
+	retention := defaultTrashRetention
+	if len(c.TrashRetention) > 0 {
+		if retention, err = time.ParseDuration(c.TrashRetention); err != nil {
+			log.Fatalf("trash retention: %s", err)
+		}
 	}
+	go purgeTrash(context.Background(), retention, trashPurgeInterval)
+	go reapExpired(context.Background(), expiryInterval)
+	if len(c.ScrubInterval) > 0 {
+		interval, err := time.ParseDuration(c.ScrubInterval)
+		if err != nil {
+			log.Fatalf("scrub interval: %s", err)
+		}
+		go scrubEvery(context.Background(), interval, c.Quarantine)
+	}
+
+	addr := fmt.Sprintf("%s:%s", c.Ip, c.Port)
+	log.Printf("Serving on %s ...", addr)
+	log.Fatal(http.ListenAndServe(addr, routes()))
+}
+
+// routes maps the server's paths to their handlers
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", routeAll)
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		httplog.DefaultFavIcon.ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/assets/", routeAssets)
+	mux.HandleFunc("/upload", routeUpload)
+	mux.HandleFunc("/urlie", routeGetFromUrl)
+	mux.HandleFunc("/all", routeAll)
+	mux.HandleFunc("/f/", routeFiles)
+	mux.HandleFunc("/v/", routeViews)
+	mux.HandleFunc("/k/", routeKeywords)
+	mux.HandleFunc("/md5/", routeMD5s)
+	mux.HandleFunc("/ext/", routeExt)
+	mux.HandleFunc("/ip/", routeIPs)
+	mux.HandleFunc("/r", routeRandom)
+	mux.HandleFunc("/retag", routeRetag)
+	mux.HandleFunc("/trash", routeTrash)
+	mux.HandleFunc(apiPrefix, routeAPI)
+	return mux
+}
 
-	if serverConfig.DbHandler == "mongo" {
+// openHandler looks up the named DbHandler, and initializes it with the
+// applicable settings from c
+func openHandler(c *config.Config, name string) (dbutil.Handler, error) {
+	h, ok := dbutil.Handles[name]
+	if !ok {
+		return nil, fmt.Errorf("DbHandler %q not found", name)
+	}
+
+	var duConfig interface{}
+	switch name {
+	case "mongo", "mongodb":
 		duConfig = struct {
 			Seed   string
 			User   string
 			Pass   string
 			DbName string
 		}{
-			serverConfig.MongoHost,
-			serverConfig.MongoUsername,
-			serverConfig.MongoPassword,
-			serverConfig.MongoDbName,
+			c.MongoHost,
+			c.MongoUsername,
+			c.MongoPassword,
+			c.MongoDbName,
+		}
+	case "fs":
+		duConfig = struct {
+			Dir string
+		}{
+			c.DataDir,
+		}
+	case "bolt":
+		duConfig = struct {
+			Path string
+		}{
+			filepath.Join(c.DataDir, "imgsrv.db"),
+		}
+	case "s3":
+		duConfig = struct {
+			Endpoint  string
+			Bucket    string
+			Region    string
+			AccessKey string
+			SecretKey string
+			PathStyle bool
+		}{
+			c.S3Endpoint,
+			c.S3Bucket,
+			c.S3Region,
+			c.S3AccessKey,
+			c.S3SecretKey,
+			c.S3PathStyle,
 		}
 	}
 
-	if err := du.Init(json.Marshal(duConfig)); err != nil {
-		log.Fatal(err)
+	if err := h.Init(json.Marshal(duConfig)); err != nil {
+		return nil, err
 	}
-	defer du.Close() // TODO this ought to catch a signal to cleanup
-
-	http.HandleFunc("/", routeRoot)
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		httplog.DefaultFavIcon.ServeHTTP(w, r)
-	})
-	http.HandleFunc("/assets/", routeAssets)
-	http.HandleFunc("/upload", routeUpload)
-	http.HandleFunc("/urlie", routeGetFromUrl)
-	http.HandleFunc("/all", routeAll)
-	http.HandleFunc("/f/", routeFiles)
-	http.HandleFunc("/v/", routeViews)
-	http.HandleFunc("/k/", routeKeywords)
-	http.HandleFunc("/md5/", routeMD5s)
-	http.HandleFunc("/ext/", routeExt)
-	http.HandleFunc("/ip/", routeIPs)
-
-	addr := fmt.Sprintf("%s:%s", c.Ip, c.Port)
-	log.Printf("Serving on %s ...", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	return h, nil
 }
 
 func serverErr(w http.ResponseWriter, r *http.Request, e error) {
@@ -119,12 +197,28 @@ func routeViewsGET(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/html")
 	if len(uriChunks) == 2 && len(uriChunks[1]) > 0 {
-		file, err := du.GetFileByFilename(uriChunks[1])
+		file, err := getFile(r.Context(), uriChunks[1])
+		if err == dbutil.ErrNotFound {
+			redirectRenamed(w, r, "/v/", uriChunks[1])
+			return
+		} else if err != nil {
+			serverErr(w, r, err)
+			return
+		}
+		if file.Metadata.IsExpired(time.Now()) {
+			gone(w, r)
+			return
+		}
+		if negotiateJSON(w, r) {
+			respondJSON(w, r, file)
+			return
+		}
+		revisions, err := du.GetRevisions(r.Context(), file.Filename)
 		if err != nil {
 			serverErr(w, r, err)
 			return
 		}
-		err = ImageViewPage(w, file)
+		err = ImageViewPage(w, file, revisions)
 		if err != nil {
 			log.Printf("error: %s", err)
 		}
@@ -136,9 +230,49 @@ func routeViewsGET(w http.ResponseWriter, r *http.Request) {
 	httplog.LogRequest(r, 200)
 }
 
+/*
+  POST /v/:name
+
+  The edit form on the view page, setting the file's keywords to the comma
+  separated list in "keywords"
+*/
+func routeViewsPOST(w http.ResponseWriter, r *http.Request) {
+	uriChunks := chunkURI(r.URL.Path)
+	if len(uriChunks) != 2 || len(uriChunks[1]) == 0 {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	}
+	filename := strings.ToLower(uriChunks[1])
+
+	file, err := getFile(r.Context(), filename)
+	if err == dbutil.ErrNotFound {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+
+	info := file.Metadata
+	info.Keywords = nil
+	for _, k := range strings.Split(r.FormValue("keywords"), ",") {
+		info.AddKeywords(strings.TrimSpace(k))
+	}
+	if err := du.UpdateInfo(r.Context(), filename, info); err != nil {
+		serverErr(w, r, err)
+		return
+	}
+
+	httplog.LogRequest(r, 302)
+	http.Redirect(w, r, fmt.Sprintf("/v/%s", filename), 302)
+}
+
 /*
   GET /f/
-  GET /f/:name
+  GET /f/:name[?v=N]
+  HEAD /f/:name[?v=N]
 */
 // Show a page of most recent images, and tags, and uploaders ...
 func routeFilesGET(w http.ResponseWriter, r *http.Request) {
@@ -159,12 +293,14 @@ func routeFilesGET(w http.ResponseWriter, r *http.Request) {
 
 	filename := strings.ToLower(uriChunks[1])
 
-	// if the Request got here by a delete request, confirm it
-	if (len(r.Form["delete"]) > 0 && r.Form["delete"][0] == "true") && (len(r.Form["confirm"]) > 0 && r.Form["confirm"][0] == "true") {
+	// if the Request got here by a delete request, confirm it.
+	// HEAD only ever describes the file.
+	deleting := r.Method == "GET" && len(r.Form["delete"]) > 0 && r.Form["delete"][0] == "true"
+	if deleting && (len(r.Form["confirm"]) > 0 && r.Form["confirm"][0] == "true") {
 		httplog.LogRequest(r, 200)
 		routeFilesDELETE(w, r)
 		return
-	} else if len(r.Form["delete"]) > 0 && r.Form["delete"][0] == "true" {
+	} else if deleting {
 		httplog.LogRequest(r, 200)
 		err = DeleteFilePage(w, filename)
 		if err != nil {
@@ -176,31 +312,64 @@ func routeFilesGET(w http.ResponseWriter, r *http.Request) {
 
 	if len(uriChunks) == 2 && len(filename) > 0 {
 		log.Printf("Searching for [%s] ...", filename)
-		c, err := du.CountFiles(filename)
 		// preliminary checks, if they've passed an image name
-		if err != nil {
+		info, err := getFile(r.Context(), filename)
+		if err == dbutil.ErrNotFound {
+			redirectRenamed(w, r, "/f/", filename)
+			return
+		} else if err != nil {
 			serverErr(w, r, err)
 			return
 		}
-		log.Printf("Results for [%s] = %d", filename, c)
-		if c == 0 {
-			httplog.LogRequest(r, 404)
-			http.NotFound(w, r)
+		if info.Metadata.IsExpired(time.Now()) {
+			gone(w, r)
 			return
 		}
 
-		ext := filepath.Ext(filename)
-		w.Header().Set("Content-Type", mime.TypeByExtension(ext))
-		w.Header().Set("Cache-Control", "max-age=315360000")
-		w.WriteHeader(http.StatusOK)
-
-		file, err := du.Open(filename)
+		var file dbutil.File
+		if v := r.Form.Get("v"); len(v) > 0 {
+			// an earlier revision, counting from 1 for the first upload
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				httplog.LogRequest(r, 400)
+				http.Error(w, "Bad Syntax", 400)
+				return
+			}
+			revisions, err := du.GetRevisions(r.Context(), filename)
+			if err != nil {
+				serverErr(w, r, err)
+				return
+			}
+			if n < 1 || n > len(revisions) {
+				httplog.LogRequest(r, 404)
+				http.NotFound(w, r)
+				return
+			}
+			info = revisions[n-1]
+			file, err = du.OpenRevision(r.Context(), filename, n)
+		} else {
+			file, err = du.Open(r.Context(), filename)
+		}
 		if err != nil {
 			serverErr(w, r, err)
 			return
 		}
+		defer file.Close()
 
-		io.Copy(w, file) // send the contents of the file in the body
+		ext := filepath.Ext(filename)
+		w.Header().Set("Content-Type", mime.TypeByExtension(ext))
+		// a name can be given other contents, by a PUT, a revision or a
+		// rename, so caches are to check back, which the ETag makes cheap
+		w.Header().Set("Cache-Control", "no-cache")
+		if len(info.Md5) > 0 {
+			w.Header().Set("ETag", fmt.Sprintf("%q", info.Md5))
+		}
+
+		// send the contents of the file in the body, or just the Range(s) asked
+		// for, so that the audio and video players can seek. This also answers
+		// HEAD, If-None-Match and If-Modified-Since, with the Content-Length
+		// from seeking to the end of the file, which is its stored Length.
+		http.ServeContent(w, r, filename, info.UploadDate, file)
 	} else {
 		// no filename given, show them the full listing
 		http.Redirect(w, r, "/all", 302)
@@ -208,8 +377,29 @@ func routeFilesGET(w http.ResponseWriter, r *http.Request) {
 	httplog.LogRequest(r, 200)
 }
 
+// redirectRenamed sends the request for a filename that is not stored on to
+// the file's new name, if that is one it had before being renamed
+func redirectRenamed(w http.ResponseWriter, r *http.Request, prefix, filename string) {
+	file, err := du.GetFileByFormerName(r.Context(), filename)
+	if err == nil && file.Metadata.IsDeleted() {
+		err = dbutil.ErrNotFound
+	}
+	if err == dbutil.ErrNotFound {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+	u := url.URL{Path: prefix + file.Filename, RawQuery: r.URL.RawQuery}
+	httplog.LogRequest(r, 301)
+	http.Redirect(w, r, u.String(), 301)
+}
+
 /*
   POST /f/[:name][?k=v&k=v]
+  POST /f/:name?rename=:newname
 */
 // Create the file by the name in the path and/or parameter?
 // add keywords from the parameters
@@ -223,6 +413,10 @@ func routeFilesPOST(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Not Acceptable", 403)
 		return
 	}
+	if to := r.URL.Query().Get("rename"); len(to) > 0 {
+		routeFilesRename(w, r, to)
+		return
+	}
 
 	var filename string
 	info := types.Info{
@@ -231,8 +425,9 @@ func routeFilesPOST(w http.ResponseWriter, r *http.Request) {
 		TimeStamp: time.Now(),
 	}
 
+	// the file may just as well be the whole request body
 	err := r.ParseMultipartForm(maxBytes)
-	if err != nil {
+	if err != nil && err != http.ErrNotMultipart {
 		serverErr(w, r, err)
 		return
 	}
@@ -257,130 +452,497 @@ func routeFilesPOST(w http.ResponseWriter, r *http.Request) {
 		p_ext = fmt.Sprintf(".%s", p_ext)
 	}
 
+	info.Keywords = formKeywords(r.Form)
+	if err := formExpires(r.FormValue("expires"), &info); err != nil {
+		log.Printf("[%s] %s", filename, err)
+		httplog.LogRequest(r, 400)
+		http.Error(w, "Bad Syntax", 400)
+		return
+	}
+
+	if len(filename) == 0 {
+		str := hash.GetSmallHash()
+		if len(p_ext) == 0 {
+			filename = fmt.Sprintf("%s.jpg", str)
+		} else {
+			filename = fmt.Sprintf("%s%s", str, p_ext)
+		}
+	}
+
+	// copy the request body into the gfs file
+	filename, n, err := storeUpload(r.Context(), filename, &info, r.Body, onConflict(r.FormValue("onconflict"), "fail"))
+	if err == dbutil.ErrExists {
+		conflict(w, r, filename)
+		return
+	} else if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+
+	if n != r.ContentLength {
+		log.Printf("WARNING: [%s] content-length (%d), content written (%d)",
+			filename,
+			r.ContentLength,
+			n)
+	}
+
+	if r.FormValue("dedup") == "true" {
+		if filename, err = dedupUpload(r.Context(), filename); err != nil {
+			serverErr(w, r, err)
+			return
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		io.WriteString(w,
+			fmt.Sprintf("<a href=\"/f/%s\">/f/%s</a>\n", filename, filename))
+	} else {
+		io.WriteString(w, fmt.Sprintf("/f/%s\n", filename))
+	}
+
+	httplog.LogRequest(r, 200)
+}
+
+/*
+  POST /f/:name?rename=:newname
+
+  Move the file to the new name, keeping its contents and metadata. The old
+  name keeps redirecting to the new one, until something else is stored as it.
+*/
+func routeFilesRename(w http.ResponseWriter, r *http.Request, to string) {
+	uriChunks := chunkURI(r.URL.Path)
+	to = strings.ToLower(to)
+	if len(uriChunks) != 2 || len(uriChunks[1]) == 0 || strings.Contains(to, "/") {
+		httplog.LogRequest(r, 400)
+		http.Error(w, "Bad Syntax", 400)
+		return
+	}
+	from := strings.ToLower(uriChunks[1])
+
+	_, err := getFile(r.Context(), from)
+	if err == nil {
+		err = du.Rename(r.Context(), from, to)
+	}
+	if err == dbutil.ErrNotFound {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	} else if err == dbutil.ErrExists {
+		conflict(w, r, to)
+		return
+	} else if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+
+	log.Printf("[%s] renamed to [%s]", from, to)
+	io.WriteString(w, fmt.Sprintf("/f/%s\n", to))
+	httplog.LogRequest(r, 200)
+}
+
+// formKeywords collects the keywords from any of the parameters they may be
+// passed as, each either one keyword or a comma separated list
+func formKeywords(form url.Values) (keywords []string) {
 	for _, word := range []string{
 		"k", "key", "keyword",
 		"keys", "keywords",
 	} {
-		v := r.FormValue(word)
+		v := form.Get(word)
 		if len(v) > 0 {
 			if strings.Contains(v, ",") {
 				for _, word := range strings.Split(v, ",") {
-					info.Keywords = append(info.Keywords, strings.Trim(word, " "))
+					keywords = append(keywords, strings.Trim(word, " "))
 				}
 			} else {
-				info.Keywords = append(info.Keywords, strings.Trim(v, " "))
+				keywords = append(keywords, strings.Trim(v, " "))
 			}
 		}
 	}
+	return keywords
+}
 
-	if len(filename) == 0 {
-		str := hash.GetSmallHash()
-		if len(p_ext) == 0 {
-			filename = fmt.Sprintf("%s.jpg", str)
-		} else {
-			filename = fmt.Sprintf("%s%s", str, p_ext)
-		}
+/*
+  PUT /f/:name
+
+  Replace the contents of the file with the request body, if there is one,
+  and add the keywords passed (?keywords=a,b), or with ?replace=true, use
+  them instead of the ones it had. The original upload time is kept, and the
+  modified time set, unless the server keeps revisions (-versioned), or the
+  file already has earlier ones, in which case the body is a new revision
+  instead. The file's updated metadata is returned, as JSON.
+*/
+func routeFilesPUT(w http.ResponseWriter, r *http.Request) {
+	uriChunks := chunkURI(r.URL.Path)
+	if len(uriChunks) != 2 || len(uriChunks[1]) == 0 {
+		httplog.LogRequest(r, 400)
+		http.Error(w, "Bad Syntax", 400)
+		return
 	}
+	filename := strings.ToLower(uriChunks[1])
 
-	exists, err := du.HasFileByFilename(filename)
-	if err == nil && !exists {
-		file, err := du.Create(filename)
-		defer file.Close()
+	orig, err := getFile(r.Context(), filename)
+	if err == dbutil.ErrNotFound {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+
+	// the body is the file, so the parameters are only read from the URL
+	var versioned bool
+	q := r.URL.Query()
+	info := orig.Metadata
+	if q.Get("replace") == "true" {
+		info.Keywords = formKeywords(q)
+	} else {
+		info.AddKeywords(formKeywords(q)...)
+	}
+
+	body, empty := requestBody(r)
+	if empty {
+		// without a new body, only the metadata changes
+		err = du.UpdateInfo(r.Context(), filename, info)
+	} else if versioned, err = keepsRevisions(r.Context(), filename); err != nil {
+		serverErr(w, r, err)
+		return
+	} else if versioned {
+		info.Ip = r.RemoteAddr
+		info.TimeStamp = time.Now()
+		info.Modified = time.Time{}
+		_, err = createUpload(r.Context(), du.CreateRevision, filename, &info, body)
+	} else {
+		info.Modified = time.Now()
+		err = replaceFile(r.Context(), filename, info, orig.UploadDate, body)
+	}
+	if err == dbutil.ErrNotFound {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+
+	updated, err := du.GetFileByFilename(r.Context(), filename)
+	if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		log.Printf("error: %s", err)
+	}
+	httplog.LogRequest(r, 200)
+}
+
+// requestBody is the body of r, and whether it is empty. A body of unknown
+// length, as a chunked one is, is peeked at to tell.
+func requestBody(r *http.Request) (io.Reader, bool) {
+	if r.ContentLength >= 0 {
+		return r.Body, r.ContentLength == 0
+	}
+	br := bufio.NewReader(r.Body)
+	_, err := br.Peek(1)
+	return br, err == io.EOF
+}
+
+// keepsRevisions is whether a new upload to filename is to be a revision, as
+// the server keeps them, or the file already has earlier ones that replacing
+// it would remove
+func keepsRevisions(ctx context.Context, filename string) (bool, error) {
+	if serverConfig.Versioned {
+		return true, nil
+	}
+	revs, err := du.GetRevisions(ctx, filename)
+	if err == dbutil.ErrNotFound {
+		return false, nil
+	}
+	return len(revs) > 1, err
+}
+
+// replaceFile stores src in place of filename, keeping its upload date
+func replaceFile(ctx context.Context, filename string, info types.Info, uploadDate time.Time, src io.Reader) error {
+	file, err := du.Replace(ctx, filename)
+	if err != nil {
+		return err
+	}
+	file.SetMeta(&info)
+	if uds, ok := file.(dbutil.UploadDateSetter); ok {
+		uds.SetUploadDate(uploadDate)
+	}
+	if _, err := io.Copy(file, src); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+  POST /retag
+
+  Add and remove keywords across many files at once. The body is JSON, naming
+  the files, and/or a keyword whose files are all to be retagged:
+
+    {"files": ["a.gif", "b.gif"], "keyword": "dogs", "add": ["dog"], "remove": ["dogs"]}
+
+  What was retagged, and what was not found, is returned as JSON.
+*/
+func routeRetag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	}
+
+	var req struct {
+		Files   []string `json:"files"`
+		Keyword string   `json:"keyword"`
+		Add     []string `json:"add"`
+		Remove  []string `json:"remove"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBytes)).Decode(&req); err != nil {
+		httplog.LogRequest(r, 400)
+		http.Error(w, "Bad Syntax", 400)
+		return
+	}
+
+	filenames := req.Files
+	if len(req.Keyword) > 0 {
+		// collected up front, as retagging may take them out of the listing
+		files, err := du.FindFilesByKeyword(r.Context(), req.Keyword, dbutil.Page{})
 		if err != nil {
 			serverErr(w, r, err)
 			return
 		}
+		for _, f := range files {
+			filenames = append(filenames, f.Filename)
+		}
+	}
 
-		file.SetMeta(&info)
-
-		// copy the request body into the gfs file
-		n, err := io.Copy(file, r.Body)
-		if err != nil {
+	res := struct {
+		Retagged []string `json:"retagged"`
+		Missing  []string `json:"missing"`
+	}{Retagged: []string{}, Missing: []string{}}
+	for _, filename := range filenames {
+		var err error
+		if len(req.Add) > 0 {
+			err = du.AddKeywords(r.Context(), filename, req.Add...)
+		}
+		if err == nil && len(req.Remove) > 0 {
+			err = du.RemoveKeywords(r.Context(), filename, req.Remove...)
+		}
+		if err == dbutil.ErrNotFound {
+			res.Missing = append(res.Missing, filename)
+			continue
+		} else if err != nil {
 			serverErr(w, r, err)
 			return
 		}
+		res.Retagged = append(res.Retagged, filename)
+	}
 
-		if n != r.ContentLength {
-			log.Printf("WARNING: [%s] content-length (%d), content written (%d)",
-				filename,
-				r.ContentLength,
-				n)
-		}
-	} else if exists {
-		if r.Method == "PUT" {
-			// TODO nothing will get here presently. Workflow needs more review
-			file, err := du.Open(filename)
-			defer file.Close()
-			if err != nil {
-				serverErr(w, r, err)
-				return
-			}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("error: %s", err)
+	}
+	httplog.LogRequest(r, 200)
+}
 
-			var mInfo types.Info
-			err = file.GetMeta(&mInfo)
-			if err != nil {
-				log.Printf("ERROR: failed to get metadata for %s. %s\n", filename, err)
-			}
-			mInfo.Keywords = append(mInfo.Keywords, info.Keywords...)
-			file.SetMeta(&mInfo)
-		} else {
-			log.Printf("[%s] already exists", filename)
+func routeFilesDELETE(w http.ResponseWriter, r *http.Request) {
+	uriChunks := chunkURI(r.URL.Path)
+	if (len(uriChunks) > 2) || (len(uriChunks) == 2 && len(uriChunks[1]) == 0) {
+		httplog.LogRequest(r, 400)
+		http.Error(w, "Bad Syntax", 400)
+		return
+	}
+
+	// only into the trash, for now. It is purged for good once it has been
+	// there for the -trash-retention.
+	file, err := getFile(r.Context(), uriChunks[1])
+	if err == dbutil.ErrNotFound {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+	info := file.Metadata
+	info.Trash(r.RemoteAddr, time.Now())
+	if err := du.UpdateInfo(r.Context(), file.Filename, info); err != nil {
+		serverErr(w, r, err)
+		return
+	}
+	log.Printf("[%s] put in the trash by %s", file.Filename, r.RemoteAddr)
+	httplog.LogRequest(r, 302)
+	http.Redirect(w, r, "/", 302)
+	// delete the name in the path and/or parameter?
+}
+
+/*
+  GET /trash
+  POST /trash
+
+  The deleted files, newest first, each with a form to restore it
+  (restore=:name) or to purge it for good now (purge=:name)
+*/
+func routeTrash(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		files, p, ok := fetchPage(w, r, du.GetTrash)
+		if !ok {
+			return
 		}
-	} else {
+		if err := ListTrashPage(w, files, p); err != nil {
+			log.Printf("error: %s", err)
+		}
+		httplog.LogRequest(r, 200)
+	case "POST":
+		routeTrashPOST(w, r)
+	default:
+		httplog.LogRequest(r, 405)
+		http.Error(w, "Method Not Allowed", 405)
+	}
+}
+
+func routeTrashPOST(w http.ResponseWriter, r *http.Request) {
+	filename := r.FormValue("restore")
+	if len(filename) == 0 {
+		filename = r.FormValue("purge")
+	}
+	file, err := du.GetFileByFilename(r.Context(), filename)
+	if err == nil && !file.Metadata.IsDeleted() {
+		err = dbutil.ErrNotFound
+	}
+	if err == dbutil.ErrNotFound {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
 		serverErr(w, r, err)
 		return
 	}
 
-	if strings.Contains(r.Header.Get("Accept"), "text/html") {
-		io.WriteString(w,
-			fmt.Sprintf("<a href=\"/f/%s\">/f/%s</a>\n", filename, filename))
+	if len(r.FormValue("restore")) > 0 {
+		info := file.Metadata
+		info.Restore()
+		err = du.UpdateInfo(r.Context(), file.Filename, info)
+		log.Printf("[%s] restored from the trash by %s", file.Filename, r.RemoteAddr)
 	} else {
-		io.WriteString(w, fmt.Sprintf("/f/%s\n", filename))
+		err = du.Remove(r.Context(), file.Filename)
+		log.Printf("[%s] purged from the trash by %s", file.Filename, r.RemoteAddr)
 	}
-
-	httplog.LogRequest(r, 200)
+	if err != nil {
+		serverErr(w, r, err)
+		return
+	}
+	httplog.LogRequest(r, 302)
+	http.Redirect(w, r, "/trash", 302)
 }
 
-func routeFilesPUT(w http.ResponseWriter, r *http.Request) {
-	// update the file by the name in the path and/or parameter?
-	// update/add keywords from the parameters
-	// look for an image in the r.Body
-	httplog.LogRequest(r, 418)
-}
+/*
+purgeTrash removes the files that have been in the trash for longer than
+retention, every interval, until the ctx is done
+*/
+func purgeTrash(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		files, err := du.GetTrash(ctx, dbutil.Page{})
+		if err != nil {
+			log.Printf("trash: %s", err)
+		}
+		cutoff := time.Now().Add(-retention)
+		for _, file := range files {
+			if file.Metadata.Deleted.After(cutoff) {
+				continue
+			}
+			if err := du.Remove(ctx, file.Filename); err != nil && err != dbutil.ErrNotFound {
+				log.Printf("trash: purging [%s]: %s", file.Filename, err)
+				continue
+			}
+			log.Printf("trash: purged [%s], deleted %s by %s", file.Filename, file.Metadata.Deleted, file.Metadata.DeletedBy)
+		}
 
-func routeFilesDELETE(w http.ResponseWriter, r *http.Request) {
-	uriChunks := chunkURI(r.URL.Path)
-	if (len(uriChunks) > 2) || (len(uriChunks) == 2 && len(uriChunks[1]) == 0) {
-		httplog.LogRequest(r, 400)
-		http.Error(w, "Bad Syntax", 400)
-		return
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	exists, err := du.HasFileByFilename(uriChunks[1])
-	if err != nil {
-		serverErr(w, r, err)
-		return
+/*
+reapExpired removes the files that have expired, every interval, until the
+ctx is done. Until then, they are answered with 410 Gone.
+*/
+func reapExpired(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		files, err := du.GetExpired(ctx, time.Now())
+		if err != nil {
+			log.Printf("expiry: %s", err)
+		}
+		for _, file := range files {
+			if err := du.Remove(ctx, file.Filename); err != nil && err != dbutil.ErrNotFound {
+				log.Printf("expiry: removing [%s]: %s", file.Filename, err)
+				continue
+			}
+			log.Printf("expiry: removed [%s], which expired %s", file.Filename, file.Metadata.Expires)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	if exists {
-		err = du.Remove(uriChunks[1])
-		if err != nil {
-			serverErr(w, r, err)
+/*
+scrubEvery checks the stored files, as fsck does, every interval, until the
+ctx is done
+*/
+func scrubEvery(ctx context.Context, interval time.Duration, quarantine bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
+		}
+
+		if _, err := scrub(ctx, du, quarantine); err != nil {
+			log.Printf("scrub: %s", err)
 		}
-		httplog.LogRequest(r, 302)
-		http.Redirect(w, r, "/", 302)
-	} else {
-		httplog.LogRequest(r, 404)
-		http.NotFound(w, r)
 	}
-	// delete the name in the path and/or parameter?
+}
+
+// gone is the response for a file that has expired, but is not removed yet
+func gone(w http.ResponseWriter, r *http.Request) {
+	httplog.LogRequest(r, 410)
+	http.Error(w, "Gone", 410)
+}
+
+// getFile is du.GetFileByFilename, but a file in the trash is ErrNotFound
+func getFile(ctx context.Context, filename string) (types.File, error) {
+	file, err := du.GetFileByFilename(ctx, filename)
+	if err == nil && file.Metadata.IsDeleted() {
+		return file, dbutil.ErrNotFound
+	}
+	return file, err
 }
 
 func routeViews(w http.ResponseWriter, r *http.Request) {
 	switch {
-	case r.Method == "GET":
+	case r.Method == "GET", r.Method == "HEAD":
 		routeViewsGET(w, r)
+	case r.Method == "POST":
+		routeViewsPOST(w, r)
 	default:
 		httplog.LogRequest(r, 404)
 		http.NotFound(w, r)
@@ -390,7 +952,7 @@ func routeViews(w http.ResponseWriter, r *http.Request) {
 
 func routeFiles(w http.ResponseWriter, r *http.Request) {
 	switch {
-	case r.Method == "GET":
+	case r.Method == "GET", r.Method == "HEAD":
 		routeFilesGET(w, r)
 	case r.Method == "PUT":
 		routeFilesPUT(w, r)
@@ -405,51 +967,158 @@ func routeFiles(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func routeRoot(w http.ResponseWriter, r *http.Request) {
+// routeAll serves / and /all alike
+func routeAll(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		httplog.LogRequest(r, 404)
 		http.NotFound(w, r)
 		return
 	}
-	// Show a page of most recent images, and tags, and uploaders ...
 
 	w.Header().Set("Content-Type", "text/html")
-	var files []types.File
-	files, err := du.GetFiles(defaultPageLimit)
-	if err != nil {
-		serverErr(w, r, err)
+
+	// Show a page of the most recent images
+	listFiles(w, r, du.GetFiles)
+}
+
+/*
+  listFiles shows the page of files, from fetch, that the request asks for
+  with ?page=N (from 1) and ?before=<RFC 3339 time>, which limits the
+  listing to the files timestamped before then. The next and previous pages
+  are linked at the bottom, or in the Link header when the files are asked
+  for as JSON. The next page is linked by the timestamp of the last file
+  shown, as its ?before, so that it need not skip all the files ahead of it.
+*/
+func listFiles(w http.ResponseWriter, r *http.Request, fetch func(context.Context, dbutil.Page) ([]types.File, error)) {
+	files, p, ok := fetchPage(w, r, fetch)
+	if !ok {
+		return
+	}
+
+	log.Printf("collected %d files", len(files))
+	if negotiateJSON(w, r) {
+		if len(p.Next) > 0 {
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"next\"", p.Next))
+		}
+		if len(p.Prev) > 0 {
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"prev\"", p.Prev))
+		}
+		if files == nil {
+			files = []types.File{}
+		}
+		respondJSON(w, r, files)
 		return
 	}
-	err = ListFilesPage(w, files)
+	err := ListFilesPage(w, files, p)
 	if err != nil {
 		log.Printf("error: %s", err)
 	}
 	httplog.LogRequest(r, 200)
 }
 
-func routeAll(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		httplog.LogRequest(r, 404)
-		http.NotFound(w, r)
-		return
+// fetchPage gets the page of files the request asks for (?page=, ?before=),
+// and the links to the pages either side. With a ?before, the page number is
+// only what it is counted as, and the files are the first ones before then.
+// If it is not ok, the error response has been sent already.
+func fetchPage(w http.ResponseWriter, r *http.Request, fetch func(context.Context, dbutil.Page) ([]types.File, error)) (files []types.File, p pager, ok bool) {
+	q := r.URL.Query()
+	n := 1
+	if v := q.Get("page"); len(v) > 0 {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			httplog.LogRequest(r, 400)
+			http.Error(w, "Bad Syntax", 400)
+			return nil, p, false
+		}
+	}
+	page := dbutil.Page{Limit: defaultPageLimit + 1}
+	if v := q.Get("before"); len(v) > 0 {
+		var err error
+		if page.Before, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			httplog.LogRequest(r, 400)
+			http.Error(w, "Bad Syntax", 400)
+			return nil, p, false
+		}
+	} else {
+		page.Offset = (n - 1) * defaultPageLimit
 	}
 
-	w.Header().Set("Content-Type", "text/html")
-
-	// Show a page of all the images
-	var files []types.File
-	files, err := du.GetFiles(-1)
+	// one more than is shown, to know whether there is a next page
+	files, err := fetch(r.Context(), page)
 	if err != nil {
 		serverErr(w, r, err)
-		return
+		return nil, p, false
 	}
-	err = ListFilesPage(w, files)
-	if err != nil {
+	if len(files) > defaultPageLimit {
+		files = files[:defaultPageLimit]
+		p.Next = pageURL(r, n+1, files[len(files)-1].Metadata.TimeStamp)
+	}
+	if n > 1 {
+		p.Prev = pageURL(r, n-1, time.Time{})
+	}
+	return files, p, true
+}
+
+// pageURL is the request's URL, but for page n, of the files before the time
+// given, or counted from the first when it is zero
+func pageURL(r *http.Request, n int, before time.Time) string {
+	u := *r.URL
+	q := u.Query()
+	if n > 1 {
+		q.Set("page", strconv.Itoa(n))
+	} else {
+		q.Del("page")
+	}
+	if !before.IsZero() {
+		q.Set("before", before.Format(time.RFC3339Nano))
+	} else {
+		q.Del("before")
+	}
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// negotiateJSON is whether the request asks for JSON, rather than the HTML
+// page, by ?format=json or its Accept header. The response varies by the
+// latter either way, which w is told of.
+func negotiateJSON(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Accept")
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, v := range r.Header["Accept"] {
+		for _, t := range strings.Split(v, ",") {
+			if mt, _, err := mime.ParseMediaType(t); err == nil && mt == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// respondJSON answers the request with v, as JSON
+func respondJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
 		log.Printf("error: %s", err)
 	}
 	httplog.LogRequest(r, 200)
 }
 
+// tagCloud shows the cloud of ic, or lists it as JSON
+func tagCloud(w http.ResponseWriter, r *http.Request, ic []types.IdCount) {
+	if negotiateJSON(w, r) {
+		if ic == nil {
+			ic = []types.IdCount{}
+		}
+		respondJSON(w, r, ic)
+		return
+	}
+	if err := ListTagCloudPage(w, ic); err != nil {
+		serverErr(w, r, err)
+	}
+}
+
 /*
   GET /k/
   GET /k/:name
@@ -470,49 +1139,28 @@ func routeKeywords(w http.ResponseWriter, r *http.Request) {
 	} else if len(uriChunks) == 1 || (len(uriChunks) == 2 && len(uriChunks[1]) == 0) {
 		// Path: /k/
 		// show a tag cloud!
-		kc, err := du.GetKeywords()
+		kc, err := du.GetKeywords(r.Context())
 		if err != nil {
 			serverErr(w, r, err)
 			return
 		}
-		err = ListTagCloudPage(w, kc)
-		if err != nil {
-			serverErr(w, r, err)
-		}
+		tagCloud(w, r, kc)
 		return
 	}
 
 	log.Printf("K: %s (%d)", uriChunks, len(uriChunks))
 
-	if uriChunks[len(uriChunks)-1] == "r" {
-		// Path: /k/
-		// TODO determine how to show a random image by keyword ...
-		log.Println("random isn't built yet")
-		httplog.LogRequest(r, 404)
+	if len(uriChunks) == 3 {
+		// Path: /k/:name/r
+		randomFile(w, r, dbutil.Pick{Keyword: uriChunks[1]})
 		return
 	}
 
-	var (
-		files []types.File
-		err   error
-	)
-	if len(uriChunks) == 2 {
-		// Path: /k/:name
-		log.Println(uriChunks[1])
-		files, err = du.FindFilesByKeyword(uriChunks[1])
-		if err != nil {
-			serverErr(w, r, err)
-			return
-		}
-	}
-
-	log.Printf("collected %d files", len(files))
-	err = ListFilesPage(w, files)
-	if err != nil {
-		log.Printf("error: %s", err)
-	}
-
-	httplog.LogRequest(r, 200)
+	// Path: /k/:name
+	log.Println(uriChunks[1])
+	listFiles(w, r, func(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+		return du.FindFilesByKeyword(ctx, uriChunks[1], page)
+	})
 }
 
 func routeMD5s(w http.ResponseWriter, r *http.Request) {
@@ -521,31 +1169,17 @@ func routeMD5s(w http.ResponseWriter, r *http.Request) {
 		httplog.LogRequest(r, 404)
 		http.NotFound(w, r)
 		return
-	} else if len(uriChunks) != 2 {
+	} else if len(uriChunks) != 2 || len(uriChunks[1]) == 0 {
 		// Path: /md5/
-		kc, err := du.GetKeywords()
-		if err != nil {
-			serverErr(w, r, err)
-			return
-		}
-		err = ListTagCloudPage(w, kc)
-		if err != nil {
-			serverErr(w, r, err)
-		}
-		return
-	}
-
-	files, err := du.FindFilesByMd5(uriChunks[1])
-	if err != nil {
-		serverErr(w, r, err)
+		// there is no cloud of sums to show, so list all the files instead
+		httplog.LogRequest(r, 302)
+		http.Redirect(w, r, "/all", 302)
 		return
 	}
-	err = ListFilesPage(w, files)
-	if err != nil {
-		log.Printf("error: %s", err)
-	}
 
-	httplog.LogRequest(r, 200)
+	listFiles(w, r, func(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+		return du.FindFilesByMd5(ctx, uriChunks[1], page)
+	})
 }
 
 /*
@@ -554,7 +1188,7 @@ func routeMD5s(w http.ResponseWriter, r *http.Request) {
   GET /ext/:name/r
 
   Show a page of file extensions, and allow paging by ext
-  If /ext/name/r then show a random image by keyword name
+  If /ext/name/r then show a random image by extension
   Otherwise 404
 */
 func routeExt(w http.ResponseWriter, r *http.Request) {
@@ -568,33 +1202,64 @@ func routeExt(w http.ResponseWriter, r *http.Request) {
 	} else if len(uriChunks) == 1 || (len(uriChunks) == 2 && len(uriChunks[1]) == 0) {
 		// Path: /ext/
 		// tag cloud of extensions used
-		ic, err := du.GetExtensions()
+		ic, err := du.GetExtensions(r.Context())
 		if err != nil {
 			serverErr(w, r, err)
 			return
 		}
 		log.Printf("ext: %#v", ic)
-		err = ListTagCloudPage(w, ic)
-		if err != nil {
-			serverErr(w, r, err)
-		}
+		tagCloud(w, r, ic)
 		return
 	}
 
 	ext := strings.ToLower(uriChunks[1])
+	if len(uriChunks) == 3 {
+		// Path: /ext/:name/r
+		randomFile(w, r, dbutil.Pick{Extension: ext})
+		return
+	}
 	ext_pat := fmt.Sprintf("%s$", ext)
-	files, err := du.FindFilesByPatt(ext_pat)
-	if err != nil {
+	log.Printf("listing files with ext %s", ext)
+	listFiles(w, r, func(ctx context.Context, page dbutil.Page) ([]types.File, error) {
+		return du.FindFilesByPatt(ctx, ext_pat, page)
+	})
+}
+
+/*
+  GET /r
+
+  Show a random image, of all of them
+*/
+func routeRandom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	}
+	randomFile(w, r, dbutil.Pick{})
+}
+
+// randomFile redirects to a file picked at random, of those pick is narrowed
+// down to, or answers with the file itself when it is asked for as JSON. The
+// response is not to be cached, so that the next one is another pick.
+func randomFile(w http.ResponseWriter, r *http.Request, pick dbutil.Pick) {
+	pick.Random = hash.Rand64()
+	file, err := du.GetRandomFile(r.Context(), pick)
+	if err == dbutil.ErrNotFound {
+		httplog.LogRequest(r, 404)
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
 		serverErr(w, r, err)
 		return
 	}
-	log.Printf("collected %d files, with ext %s", len(files), ext)
-	err = ListFilesPage(w, files)
-	if err != nil {
-		log.Printf("error: %s", err)
+	w.Header().Set("Cache-Control", "no-store")
+	if negotiateJSON(w, r) {
+		respondJSON(w, r, file)
+		return
 	}
-
-	httplog.LogRequest(r, 200)
+	httplog.LogRequest(r, 302)
+	http.Redirect(w, r, "/f/"+file.Filename, 302)
 }
 
 // Show a page of all the uploader's IPs, and the images
@@ -627,7 +1292,10 @@ func routeGetFromUrl(w http.ResponseWriter, r *http.Request) {
 			err             error
 			stored_filename string
 			local_filename  string
-			useRandName     bool = false
+			useRandName     bool   = false
+			dedup           bool   = false
+			expires         string = ""
+			onconflict      string = onConflict("", "rename")
 			info            types.Info
 		)
 
@@ -661,17 +1329,24 @@ func routeGetFromUrl(w http.ResponseWriter, r *http.Request) {
 				// Yay, hopefully we got an image!
 			} else if k == "rand" {
 				useRandName = true
+			} else if k == "dedup" {
+				dedup = true
+			} else if k == "onconflict" {
+				onconflict = onConflict(v[0], "rename")
+			} else if k == "expires" {
+				expires = v[0]
 			} else {
 				log.Printf("WARN: not sure what to do with param [%s = %s]", k, v)
 			}
 		}
-		exists, err := du.HasFileByFilename(filepath.Base(strings.ToLower(local_filename)))
-		if err != nil {
-			serverErr(w, r, err)
+		if err := formExpires(expires, &info); err != nil {
+			log.Printf("%s", err)
+			httplog.LogRequest(r, 400)
+			http.Error(w, "Bad Syntax", 400)
 			return
 		}
 
-		if exists || useRandName {
+		if useRandName {
 			ext := filepath.Ext(local_filename)
 			str := hash.GetSmallHash()
 			stored_filename = fmt.Sprintf("%s%s", str, ext)
@@ -679,30 +1354,31 @@ func routeGetFromUrl(w http.ResponseWriter, r *http.Request) {
 			stored_filename = filepath.Base(local_filename)
 		}
 
-		file, err := du.Create(stored_filename)
-		defer file.Close()
-		if err != nil {
-			serverErr(w, r, err)
-			return
-		}
-
 		local_fh, err := os.Open(local_filename)
-		defer local_fh.Close()
 		if err != nil {
 			serverErr(w, r, err)
 			return
 		}
-
-		file.SetMeta(&info)
+		defer local_fh.Close()
 
 		// copy the request body into the gfs file
-		n, err := io.Copy(file, local_fh)
-		if err != nil {
+		stored_filename, n, err := storeUpload(r.Context(), stored_filename, &info, local_fh, onconflict)
+		if err == dbutil.ErrExists {
+			conflict(w, r, stored_filename)
+			return
+		} else if err != nil {
 			serverErr(w, r, err)
 			return
 		}
 		log.Printf("Wrote [%d] bytes from %s to %s", n, local_filename, stored_filename)
 
+		if dedup {
+			if stored_filename, err = dedupUpload(r.Context(), stored_filename); err != nil {
+				serverErr(w, r, err)
+				return
+			}
+		}
+
 		http.Redirect(w, r, fmt.Sprintf("/v/%s", stored_filename), 302)
 	} else {
 		httplog.LogRequest(r, 404)
@@ -742,6 +1418,9 @@ func routeUpload(w http.ResponseWriter, r *http.Request) {
 		}
 		useRandName := false
 		returnUrl := false
+		dedup := false
+		expires := ""
+		onconflict := onConflict("", "rename")
 		log.Printf("%q", r.MultipartForm.Value)
 		for k, v := range r.MultipartForm.Value {
 			if k == "keywords" {
@@ -750,41 +1429,45 @@ func routeUpload(w http.ResponseWriter, r *http.Request) {
 				useRandName = true
 			} else if k == "returnUrl" {
 				returnUrl = true
+			} else if k == "dedup" {
+				dedup = true
+			} else if k == "onconflict" {
+				onconflict = onConflict(v[0], "rename")
+			} else if k == "expires" {
+				expires = v[0]
 			} else {
 				log.Printf("WARN: not sure what to do with param [%s = %s]", k, v)
 			}
 		}
+		if err := formExpires(expires, &info); err != nil {
+			log.Printf("%s", err)
+			httplog.LogRequest(r, 400)
+			http.Error(w, "Bad Syntax", 400)
+			return
+		}
 
 		log.Printf("%#v", r.MultipartForm.File)
 		filehdr := r.MultipartForm.File["filename"][0]
 		filename := filehdr.Filename
-		exists, err := du.HasFileByFilename(filename)
-		if err != nil {
-			serverErr(w, r, err)
-			return
-		}
-		if exists || useRandName {
+		if useRandName {
 			ext := filepath.Ext(filename)
 			str := hash.GetSmallHash()
 			filename = strings.ToLower(fmt.Sprintf("%s%s", str, ext))
 		}
 
-		file, err := du.Create(filename)
-		defer file.Close()
+		multiFile, err := filehdr.Open()
 		if err != nil {
-			log.Printf("Failed to create on gfs: %s", err)
+			log.Printf("Failed to open from MultipartForm: %s", err)
 			serverErr(w, r, err)
 			return
 		}
-		file.SetMeta(&info)
+		defer multiFile.Close()
 
-		multiFile, err := filehdr.Open()
-		if err != nil {
-			log.Printf("Failed to open from MultipartForm: %s", err)
+		filename, n, err := storeUpload(r.Context(), filename, &info, multiFile, onconflict)
+		if err == dbutil.ErrExists {
+			conflict(w, r, filename)
 			return
-		}
-		n, err := io.Copy(file, multiFile)
-		if err != nil {
+		} else if err != nil {
 			log.Printf("Failed copy from MultipartForm to gfs: %s", err)
 			serverErr(w, r, err)
 			return
@@ -796,6 +1479,13 @@ func routeUpload(w http.ResponseWriter, r *http.Request) {
 				n)
 		}
 
+		if dedup {
+			if filename, err = dedupUpload(r.Context(), filename); err != nil {
+				serverErr(w, r, err)
+				return
+			}
+		}
+
 		if returnUrl {
 			fmt.Fprintf(w, "/v/%s", filename)
 			return
@@ -809,6 +1499,134 @@ func routeUpload(w http.ResponseWriter, r *http.Request) {
 	httplog.LogRequest(r, 200) // if we make it this far, then log success
 }
 
+// formExpires sets info to expire once the duration v, like "24h", has passed
+// since its TimeStamp. An empty v is no expiry.
+func formExpires(v string, info *types.Info) error {
+	if len(v) == 0 {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("expires: %s", err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("expires: %q is not in the future", v)
+	}
+	info.ExpireIn(d, info.TimeStamp)
+	return nil
+}
+
+// onConflict is what to do with an upload whose filename is taken, as the
+// onconflict parameter v says: "fail", "rename" or "version". Otherwise it is
+// "version" if the server keeps revisions, or def.
+func onConflict(v, def string) string {
+	switch v {
+	case "fail", "rename", "version":
+		return v
+	}
+	if serverConfig.Versioned {
+		return "version"
+	}
+	return def
+}
+
+/*
+storeUpload copies src into a new file named filename, with info. If the name
+is taken, what happens is up to onconflict. With "version", the upload is a
+new revision of the file. With "rename", it is stored under a fresh
+hash.GetSmallHash name instead, with the same extension, as long as src can be
+rewound for another go. It returns the name the file was stored under, or that
+was taken, with dbutil.ErrExists.
+*/
+func storeUpload(ctx context.Context, filename string, info *types.Info, src io.Reader, onconflict string) (string, int64, error) {
+	filename = strings.ToLower(filename)
+	if onconflict == "version" {
+		// not onto a file in the trash, which would take the new one with it
+		if file, err := du.GetFileByFilename(ctx, filename); err == nil && file.Metadata.IsDeleted() {
+			return filename, 0, dbutil.ErrExists
+		}
+		n, err := createUpload(ctx, du.CreateRevision, filename, info, src)
+		return filename, n, err
+	}
+	for tries := 0; ; tries++ {
+		n, err := createUpload(ctx, du.CreateNew, filename, info, src)
+		if err != dbutil.ErrExists || onconflict != "rename" || tries == maxRenames {
+			return filename, n, err
+		}
+		if n > 0 {
+			// it was only found to be taken once it was written out
+			s, ok := src.(io.Seeker)
+			if !ok {
+				return filename, n, err
+			}
+			if _, err := s.Seek(0, io.SeekStart); err != nil {
+				return filename, n, err
+			}
+		}
+		log.Printf("[%s] already exists, renaming", filename)
+		filename = strings.ToLower(fmt.Sprintf("%s%s", hash.GetSmallHash(), filepath.Ext(filename)))
+	}
+}
+
+// createUpload copies src into the file made by create, with info
+func createUpload(ctx context.Context, create func(context.Context, string) (dbutil.File, error), filename string, info *types.Info, src io.Reader) (int64, error) {
+	file, err := create(ctx, filename)
+	if err != nil {
+		return 0, err
+	}
+	file.SetMeta(info)
+	n, err := io.Copy(file, src)
+	if err != nil {
+		file.Close()
+		return n, err
+	}
+	return n, file.Close()
+}
+
+// conflict is the response to an upload whose filename is taken
+func conflict(w http.ResponseWriter, r *http.Request, filename string) {
+	log.Printf("[%s] already exists", filename)
+	httplog.LogRequest(r, 409)
+	http.Error(w, fmt.Sprintf("/f/%s already exists", filename), 409)
+}
+
+/*
+dedupUpload looks for an earlier upload with the same contents as the one just
+stored as filename. If there is one, the new upload is removed again, its
+keywords are added to the earlier one, and the earlier name is returned in its
+place. Earlier uploads that are to expire, or have, though not removed yet,
+are passed over. An upload kept as a new revision of filename is left as it
+is, as removing it would take its history with it, and so is one that is to
+expire itself.
+*/
+func dedupUpload(ctx context.Context, filename string) (string, error) {
+	revs, err := du.GetRevisions(ctx, filename)
+	if err != nil {
+		return "", err
+	}
+	file := revs[len(revs)-1]
+	if len(revs) > 1 || !file.Metadata.Expires.IsZero() {
+		return filename, nil
+	}
+	files, err := du.FindFilesByMd5(ctx, file.Md5, dbutil.Page{})
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if f.Filename == file.Filename || !f.Metadata.Expires.IsZero() {
+			continue
+		}
+		log.Printf("[%s] is a duplicate of [%s]", filename, f.Filename)
+		if len(file.Metadata.Keywords) > 0 {
+			if err := du.AddKeywords(ctx, f.Filename, file.Metadata.Keywords...); err != nil {
+				return "", err
+			}
+		}
+		return f.Filename, du.Remove(ctx, filename)
+	}
+	return filename, nil
+}
+
 func routeAssets(w http.ResponseWriter, r *http.Request) {
 	path, err := filepath.Rel("/assets", r.URL.Path)
 	if err != nil {
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vbatts/imgsrv/config"
+	"github.com/vbatts/imgsrv/dbutil"
+	_ "github.com/vbatts/imgsrv/dbutil/memory"
+	"github.com/vbatts/imgsrv/types"
+)
+
+// testServer serves the routes from an empty memory DbHandler
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	h := dbutil.Handles["memory"]
+	if err := h.Init(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	du = h
+	serverConfig = config.Config{}
+	ts := httptest.NewServer(routes())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// do sends a request to ts, and returns the response with its body read
+func do(t *testing.T, ts *httptest.Server, method, path string, body io.Reader, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	// redirects are looked at, not followed
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(buf)
+}
+
+// upload POSTs content to path, and fails the test on anything but a 200
+func upload(t *testing.T, ts *httptest.Server, path, content string) string {
+	t.Helper()
+	res, body := do(t, ts, "POST", path, strings.NewReader(content), nil)
+	if res.StatusCode != 200 {
+		t.Fatalf("POST %s: %d %q", path, res.StatusCode, body)
+	}
+	return strings.TrimSpace(body)
+}
+
+func TestDedupUpload(t *testing.T) {
+	ts := testServer(t)
+	ctx := context.Background()
+
+	upload(t, ts, "/f/first.txt", "same")
+	if actual := upload(t, ts, "/f/second.txt?dedup=true", "same"); actual != "/f/first.txt" {
+		t.Errorf("expected the earlier upload, got %q", actual)
+	}
+	if _, err := du.GetFileByFilename(ctx, "second.txt"); err != dbutil.ErrNotFound {
+		t.Errorf("expected the duplicate to be removed, got %v", err)
+	}
+
+	// the duplicate's keywords are kept on the earlier upload
+	upload(t, ts, "/f/third.txt?dedup=true&keywords=cats", "same")
+	if f, err := du.GetFileByFilename(ctx, "first.txt"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(f.Metadata.Keywords, []string{"cats"}) {
+		t.Errorf("expected the duplicate's keywords on the earlier upload, got %q", f.Metadata.Keywords)
+	}
+
+	// uploads that are to expire are neither kept in place of another, nor
+	// taken in place of one
+	if actual := upload(t, ts, "/f/expiring.txt?dedup=true&expires=1h", "same"); actual != "/f/expiring.txt" {
+		t.Errorf("expected the expiring upload to be kept, got %q", actual)
+	}
+	upload(t, ts, "/f/soon.txt?expires=1h", "other")
+	if actual := upload(t, ts, "/f/kept.txt?dedup=true", "other"); actual != "/f/kept.txt" {
+		t.Errorf("expected the upload to be kept over an expiring one, got %q", actual)
+	}
+}
+
+func TestDedupUploadRevision(t *testing.T) {
+	ts := testServer(t)
+	ctx := context.Background()
+
+	upload(t, ts, "/f/first.txt", "same")
+	upload(t, ts, "/f/second.txt", "before")
+	if actual := upload(t, ts, "/f/second.txt?onconflict=version&dedup=true", "same"); actual != "/f/second.txt" {
+		t.Errorf("expected the revision to be kept, got %q", actual)
+	}
+	revs, err := du.GetRevisions(ctx, "second.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 {
+		t.Fatalf("expected 2 revisions, got %d", len(revs))
+	}
+	_, body := do(t, ts, "GET", "/f/second.txt", nil, nil)
+	if body != "same" {
+		t.Errorf("expected the new revision to be current, got %q", body)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/cached.txt", "contents")
+
+	for path, expected := range map[string]string{
+		"/f/cached.txt":        "no-cache",
+		"/assets/bootstrap.js": "max-age=315360000, public",
+	} {
+		res, _ := do(t, ts, "GET", path, nil, nil)
+		if actual := res.Header.Get("Cache-Control"); actual != expected {
+			t.Errorf("%s: Cache-Control %q, expected %q", path, actual, expected)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/range.webm", "0123456789")
+
+	res, body := do(t, ts, "GET", "/f/range.webm", nil, map[string]string{"Range": "bytes=2-5"})
+	if res.StatusCode != 206 || body != "2345" || res.Header.Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("bytes=2-5: %d %q %q", res.StatusCode, res.Header.Get("Content-Range"), body)
+	}
+	if _, body = do(t, ts, "GET", "/f/range.webm", nil, map[string]string{"Range": "bytes=-3"}); body != "789" {
+		t.Errorf("bytes=-3: %q", body)
+	}
+	if res, _ = do(t, ts, "GET", "/f/range.webm", nil, map[string]string{"Range": "bytes=20-"}); res.StatusCode != 416 {
+		t.Errorf("bytes=20-: %d, expected 416", res.StatusCode)
+	}
+	if res, _ = do(t, ts, "GET", "/f/range.webm", nil, nil); res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Accept-Ranges %q", res.Header.Get("Accept-Ranges"))
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/etag.txt", "contents")
+
+	res, _ := do(t, ts, "GET", "/f/etag.txt", nil, nil)
+	etag, modified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if etag != `"98bf7d8c15784f0a3d63204441e1e2aa"` || len(modified) == 0 {
+		t.Fatalf("ETag %q, Last-Modified %q", etag, modified)
+	}
+	for header, value := range map[string]string{"If-None-Match": etag, "If-Modified-Since": modified} {
+		res, body := do(t, ts, "GET", "/f/etag.txt", nil, map[string]string{header: value})
+		if res.StatusCode != 304 || len(body) > 0 {
+			t.Errorf("%s: %d %q, expected a 304", header, res.StatusCode, body)
+		}
+	}
+	if res, _ := do(t, ts, "GET", "/f/etag.txt", nil, map[string]string{"If-None-Match": `"other"`}); res.StatusCode != 200 {
+		t.Errorf("If-None-Match another ETag: %d", res.StatusCode)
+	}
+
+	res, body := do(t, ts, "HEAD", "/f/etag.txt", nil, nil)
+	if res.StatusCode != 200 || len(body) > 0 || res.ContentLength != int64(len("contents")) || res.Header.Get("ETag") != etag {
+		t.Errorf("HEAD: %d %d %q", res.StatusCode, res.ContentLength, body)
+	}
+}
+
+func TestPutKeepsRevisions(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/put.txt", "one")
+	upload(t, ts, "/f/put.txt?onconflict=version", "two")
+
+	if res, body := do(t, ts, "PUT", "/f/put.txt", strings.NewReader("three"), nil); res.StatusCode != 200 {
+		t.Fatalf("PUT: %d %q", res.StatusCode, body)
+	}
+	revs, err := du.GetRevisions(context.Background(), "put.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 {
+		t.Fatalf("expected 3 revisions, got %d", len(revs))
+	}
+	for v, expected := range map[string]string{"1": "one", "2": "two", "3": "three"} {
+		if _, body := do(t, ts, "GET", "/f/put.txt?v="+v, nil, nil); body != expected {
+			t.Errorf("revision %s is %q, expected %q", v, body, expected)
+		}
+	}
+}
+
+func TestPut(t *testing.T) {
+	ts := testServer(t)
+	ctx := context.Background()
+	upload(t, ts, "/f/retag.txt?keywords=a,b", "before")
+	orig, err := du.GetFileByFilename(ctx, "retag.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var updated types.File
+	res, body := do(t, ts, "PUT", "/f/retag.txt?keywords=c", nil, nil)
+	decode(t, body, &updated)
+	if res.StatusCode != 200 || !reflect.DeepEqual(updated.Metadata.Keywords, []string{"a", "b", "c"}) {
+		t.Errorf("PUT ?keywords=c: %d %q", res.StatusCode, body)
+	}
+	_, body = do(t, ts, "PUT", "/f/retag.txt?keywords=d&replace=true", nil, nil)
+	decode(t, body, &updated)
+	if !reflect.DeepEqual(updated.Metadata.Keywords, []string{"d"}) {
+		t.Errorf("PUT ?keywords=d&replace=true: %q", body)
+	}
+
+	_, body = do(t, ts, "PUT", "/f/retag.txt", strings.NewReader("after"), nil)
+	decode(t, body, &updated)
+	if updated.Md5 == orig.Md5 || !updated.UploadDate.Equal(orig.UploadDate) || updated.Metadata.Modified.IsZero() {
+		t.Errorf("PUT with a body: %q", body)
+	}
+	if _, body = do(t, ts, "GET", "/f/retag.txt", nil, nil); body != "after" {
+		t.Errorf("GET after PUT: %q", body)
+	}
+	if revs, err := du.GetRevisions(ctx, "retag.txt"); err != nil || len(revs) != 1 {
+		t.Errorf("PUT kept %d revisions (%v), expected 1", len(revs), err)
+	}
+
+	if res, _ := do(t, ts, "PUT", "/f/missing.txt", strings.NewReader("new"), nil); res.StatusCode != 404 {
+		t.Errorf("PUT to a missing file: %d", res.StatusCode)
+	}
+	if res, _ := do(t, ts, "PUT", "/f/", nil, nil); res.StatusCode != 400 {
+		t.Errorf("PUT without a name: %d", res.StatusCode)
+	}
+}
+
+func TestPutChunkedEmpty(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/chunked.txt?keywords=a", "before")
+
+	// an empty body of unknown length is only metadata, as one of none is
+	req, err := http.NewRequest("PUT", ts.URL+"/f/chunked.txt?keywords=b", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.TransferEncoding = []string{"chunked"}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("chunked PUT: %d", res.StatusCode)
+	}
+	if _, body := do(t, ts, "GET", "/f/chunked.txt", nil, nil); body != "before" {
+		t.Errorf("GET after an empty chunked PUT: %q", body)
+	}
+	f, err := du.GetFileByFilename(context.Background(), "chunked.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.Metadata.Keywords, []string{"a", "b"}) {
+		t.Errorf("keywords after an empty chunked PUT: %q", f.Metadata.Keywords)
+	}
+}
+
+func TestRenameRedirect(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/old.png", "contents")
+	upload(t, ts, "/f/taken.png", "other")
+
+	if body := upload(t, ts, "/f/old.png?rename=New.png", ""); body != "/f/new.png" {
+		t.Errorf("rename answered %q", body)
+	}
+	for path, expected := range map[string]string{
+		"/f/old.png":     "/f/new.png",
+		"/f/old.png?v=1": "/f/new.png?v=1",
+		"/v/old.png":     "/v/new.png",
+	} {
+		res, _ := do(t, ts, "GET", path, nil, nil)
+		if res.StatusCode != 301 || res.Header.Get("Location") != expected {
+			t.Errorf("GET %s: %d to %q, expected a 301 to %q", path, res.StatusCode, res.Header.Get("Location"), expected)
+		}
+	}
+	if res, _ := do(t, ts, "GET", "/f/never.png", nil, nil); res.StatusCode != 404 {
+		t.Errorf("GET of a name never stored: %d", res.StatusCode)
+	}
+	if res, _ := do(t, ts, "POST", "/f/new.png?rename=taken.png", strings.NewReader(""), nil); res.StatusCode != 409 {
+		t.Errorf("rename to a name taken: %d", res.StatusCode)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	ts := testServer(t)
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	upload(t, ts, "/f/restored.png", "restored")
+	upload(t, ts, "/f/purged.png", "purged")
+
+	for _, name := range []string{"restored.png", "purged.png"} {
+		if res, _ := do(t, ts, "DELETE", "/f/"+name, nil, nil); res.StatusCode != 302 {
+			t.Fatalf("DELETE %s: %d", name, res.StatusCode)
+		}
+		if res, _ := do(t, ts, "GET", "/f/"+name, nil, nil); res.StatusCode != 404 {
+			t.Errorf("GET %s in the trash: %d", name, res.StatusCode)
+		}
+	}
+	if _, body := do(t, ts, "GET", "/trash", nil, nil); !strings.Contains(body, "restored.png") || !strings.Contains(body, "purged.png") {
+		t.Errorf("the trash page lists neither: %q", body)
+	}
+
+	if res, _ := do(t, ts, "POST", "/trash", strings.NewReader("restore=restored.png"), form); res.StatusCode != 302 {
+		t.Errorf("restore: %d", res.StatusCode)
+	}
+	if _, body := do(t, ts, "GET", "/f/restored.png", nil, nil); body != "restored" {
+		t.Errorf("GET after the restore: %q", body)
+	}
+	if res, _ := do(t, ts, "POST", "/trash", strings.NewReader("purge=purged.png"), form); res.StatusCode != 302 {
+		t.Errorf("purge: %d", res.StatusCode)
+	}
+	if _, err := du.GetFileByFilename(context.Background(), "purged.png"); err != dbutil.ErrNotFound {
+		t.Errorf("GetFileByFilename after the purge = %v", err)
+	}
+
+	// only what is in the trash can be restored or purged
+	for _, body := range []string{"restore=restored.png", "purge=restored.png", "purge=never.png"} {
+		if res, _ := do(t, ts, "POST", "/trash", strings.NewReader(body), form); res.StatusCode != 404 {
+			t.Errorf("POST %s: %d, expected a 404", body, res.StatusCode)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	ts := testServer(t)
+	ctx := context.Background()
+	upload(t, ts, "/f/expiring.png?expires=1h", "contents")
+	if res, _ := do(t, ts, "GET", "/f/expiring.png", nil, nil); res.StatusCode != 200 {
+		t.Fatalf("GET before it expires: %d", res.StatusCode)
+	}
+
+	file, err := du.GetFileByFilename(ctx, "expiring.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Metadata.Expires = time.Now().Add(-time.Second)
+	if err := du.UpdateInfo(ctx, "expiring.png", file.Metadata); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/f/expiring.png", "/v/expiring.png", apiPrefix + "files/expiring.png"} {
+		if res, _ := do(t, ts, "GET", path, nil, nil); res.StatusCode != 410 {
+			t.Errorf("GET %s once it expired: %d, expected a 410", path, res.StatusCode)
+		}
+	}
+
+	reaping, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		reapExpired(reaping, time.Hour)
+		close(done)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+	for i := 0; ; i++ {
+		if _, err := du.GetFileByFilename(ctx, "expiring.png"); err == dbutil.ErrNotFound {
+			break
+		} else if i == 100 {
+			t.Fatalf("the expired file was not removed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if res, _ := do(t, ts, "GET", "/f/expiring.png", nil, nil); res.StatusCode != 404 {
+		t.Errorf("GET once it is removed: %d, expected a 404", res.StatusCode)
+	}
+
+	for _, expires := range []string{"-1h", "tomorrow"} {
+		if res, _ := do(t, ts, "POST", "/f/bad.png?expires="+expires, strings.NewReader("contents"), nil); res.StatusCode != 400 {
+			t.Errorf("POST ?expires=%s: %d, expected a 400", expires, res.StatusCode)
+		}
+	}
+}
+
+func TestNegotiateJSON(t *testing.T) {
+	ts := testServer(t)
+	upload(t, ts, "/f/first.png?keywords=cats", "first")
+	upload(t, ts, "/f/second.gif?keywords=cats,dogs", "second")
+	asked := map[string]string{"Accept": "text/html;q=0.9, application/json"}
+
+	for _, path := range []string{"/all?format=json", "/k/cats?format=json", "/ext/gif?format=json", "/md5/8b04d5e3775d298e78455efc5ca404d5?format=json"} {
+		var files []types.File
+		res, body := do(t, ts, "GET", path, nil, nil)
+		decode(t, body, &files)
+		if res.Header.Get("Content-Type") != "application/json" || res.Header.Get("Vary") != "Accept" || len(files) == 0 {
+			t.Errorf("GET %s: %q %q", path, res.Header.Get("Content-Type"), body)
+		}
+	}
+	if _, body := do(t, ts, "GET", "/md5/00000000000000000000000000000000?format=json", nil, nil); body != "[]\n" {
+		t.Errorf("GET an md5 not stored: %q", body)
+	}
+	var files []types.File
+	_, body := do(t, ts, "GET", "/k/dogs", nil, asked)
+	decode(t, body, &files)
+	if len(files) != 1 || files[0].Filename != "second.gif" {
+		t.Errorf("GET /k/dogs, accepting JSON: %q", body)
+	}
+	var counts []types.IdCount
+	_, body = do(t, ts, "GET", "/k/", nil, asked)
+	decode(t, body, &counts)
+	if len(counts) != 2 || counts[0].Id != "cats" || counts[0].Value != 2 {
+		t.Errorf("GET /k/, accepting JSON: %q", body)
+	}
+	var file types.File
+	_, body = do(t, ts, "GET", "/v/first.png?format=json", nil, nil)
+	decode(t, body, &file)
+	if file.Filename != "first.png" || file.Length != uint64(len("first")) {
+		t.Errorf("GET /v/first.png?format=json: %q", body)
+	}
+	if res, _ := do(t, ts, "GET", "/all", nil, nil); !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("GET /all without asking for JSON: %q", res.Header.Get("Content-Type"))
+	}
+
+	defer func(limit int) { defaultPageLimit = limit }(defaultPageLimit)
+	defaultPageLimit = 1
+	res, body := do(t, ts, "GET", "/all?format=json", nil, nil)
+	decode(t, body, &files)
+	// the next page is the files before the last one shown
+	expected := []string{fmt.Sprintf(`</all?before=%s&format=json&page=2>; rel="next"`,
+		url.QueryEscape(files[0].Metadata.TimeStamp.Format(time.RFC3339Nano)))}
+	if !reflect.DeepEqual(res.Header["Link"], expected) {
+		t.Fatalf("GET /all?format=json: Link %q, expected %q", res.Header["Link"], expected)
+	}
+	next := strings.TrimPrefix(strings.Split(expected[0], ">")[0], "<")
+	var page2 []types.File
+	res, body = do(t, ts, "GET", next, nil, nil)
+	decode(t, body, &page2)
+	if len(page2) != 1 || page2[0].Filename == files[0].Filename {
+		t.Errorf("GET %s: %q", next, body)
+	}
+	if expected := []string{`</all?format=json>; rel="prev"`}; !reflect.DeepEqual(res.Header["Link"], expected) {
+		t.Errorf("GET %s: Link %q, expected %q", next, res.Header["Link"], expected)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	ts := testServer(t)
+	if res, _ := do(t, ts, "GET", "/r", nil, nil); res.StatusCode != 404 {
+		t.Errorf("GET /r with nothing stored: %d", res.StatusCode)
+	}
+	upload(t, ts, "/f/cat.png?keywords=cats", "cat")
+	upload(t, ts, "/f/dog.gif?keywords=dogs", "dog")
+	upload(t, ts, "/f/trashed.jpg?keywords=trash", "trashed")
+	do(t, ts, "DELETE", "/f/trashed.jpg", nil, nil)
+
+	for path, expected := range map[string]string{
+		"/k/cats/r":  "/f/cat.png",
+		"/k/DOGS/r":  "/f/dog.gif",
+		"/ext/png/r": "/f/cat.png",
+		"/ext/gif/r": "/f/dog.gif",
+	} {
+		res, _ := do(t, ts, "GET", path, nil, nil)
+		if res.StatusCode != 302 || res.Header.Get("Location") != expected || res.Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("GET %s: %d to %q (%q), expected a 302 to %q", path, res.StatusCode, res.Header.Get("Location"), res.Header.Get("Cache-Control"), expected)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		res, _ := do(t, ts, "GET", "/r", nil, nil)
+		if loc := res.Header.Get("Location"); loc != "/f/cat.png" && loc != "/f/dog.gif" {
+			t.Errorf("GET /r: %d to %q", res.StatusCode, loc)
+		}
+	}
+	for _, path := range []string{"/k/trash/r", "/ext/jpg/r", "/k/none/r"} {
+		if res, _ := do(t, ts, "GET", path, nil, nil); res.StatusCode != 404 {
+			t.Errorf("GET %s: %d, expected a 404", path, res.StatusCode)
+		}
+	}
+
+	var file types.File
+	_, body := do(t, ts, "GET", "/k/cats/r?format=json", nil, nil)
+	decode(t, body, &file)
+	if file.Filename != "cat.png" {
+		t.Errorf("GET /k/cats/r?format=json: %q", body)
+	}
+	if res, _ := do(t, ts, "GET", "/k/cats/x", nil, nil); res.StatusCode != 404 {
+		t.Errorf("GET /k/cats/x: %d", res.StatusCode)
+	}
+}
@@ -12,13 +12,109 @@ type Info struct {
 	Ip        string   // who uploaded it
 	Random    int64
 	TimeStamp time.Time "timestamp,omitempty"
+	Modified  time.Time "modified,omitempty"  // last change since the upload, if any
+	Renamed   []string  "renamed,omitempty"   // names the file had before, which still lead to it
+	Deleted   time.Time "deleted,omitempty"   // when the file was put in the trash, if it was
+	DeletedBy string    "deletedby,omitempty" // who put it there
+
+	Superseded time.Time "superseded,omitempty" // when a newer revision took its place, if one did
+	Expires    time.Time "expires,omitempty"    // when the file is to stop being served, and be removed, if ever
+}
+
+// AddKeywords adds the keywords that the Info does not have yet
+func (i *Info) AddKeywords(keywords ...string) {
+	for _, k := range keywords {
+		if len(k) > 0 && !contains(i.Keywords, k) {
+			i.Keywords = append(i.Keywords, k)
+		}
+	}
+}
+
+// RemoveKeywords takes the keywords out of the Info
+func (i *Info) RemoveKeywords(keywords ...string) {
+	i.Keywords = without(i.Keywords, keywords...)
+}
+
+// HasKeyword is whether keyword is one of the Info's Keywords
+func (i *Info) HasKeyword(keyword string) bool {
+	return contains(i.Keywords, keyword)
+}
+
+// RenamedFrom records a rename of the file, from one name to the other. The
+// new name is no longer a former one, if it ever was.
+func (i *Info) RenamedFrom(from, to string) {
+	i.Renamed = without(i.Renamed, from, to)
+	i.Renamed = append(i.Renamed, from)
+}
+
+// HasRenamed is whether the file was once named filename
+func (i *Info) HasRenamed(filename string) bool {
+	return contains(i.Renamed, filename)
+}
+
+// Trash marks the file as deleted by ip, at t
+func (i *Info) Trash(ip string, t time.Time) {
+	i.Deleted = t.Round(0) // as it will be once stored
+	i.DeletedBy = ip
+}
+
+// Restore takes the file back out of the trash
+func (i *Info) Restore() {
+	i.Deleted = time.Time{}
+	i.DeletedBy = ""
+}
+
+// IsDeleted is whether the file is in the trash
+func (i *Info) IsDeleted() bool {
+	return !i.Deleted.IsZero()
+}
+
+// IsSuperseded is whether the file is an earlier revision of another
+func (i *Info) IsSuperseded() bool {
+	return !i.Superseded.IsZero()
+}
+
+// ExpireIn sets the file to expire once d has passed since t
+func (i *Info) ExpireIn(d time.Duration, t time.Time) {
+	i.Expires = t.Add(d).Round(0) // as it will be once stored
+}
+
+// IsExpired is whether the file has an expiry, and it is past at t
+func (i *Info) IsExpired(t time.Time) bool {
+	return !i.Expires.IsZero() && !i.Expires.After(t)
+}
+
+// Hidden is whether the file is left out of the listings, and the keyword and
+// extension counts, being in the trash or an earlier revision
+func (i *Info) Hidden() bool {
+	return i.IsDeleted() || i.IsSuperseded()
+}
+
+func contains(list []string, s string) bool {
+	for _, this := range list {
+		if this == s {
+			return true
+		}
+	}
+	return false
+}
+
+// without is the list, less any of the values
+func without(list []string, values ...string) []string {
+	kept := []string{}
+	for _, this := range list {
+		if !contains(values, this) {
+			kept = append(kept, this)
+		}
+	}
+	return kept
 }
 
 type File struct {
 	Metadata   Info ",omitempty"
 	Md5        string
-	ChunkSize  int
-	UploadDate time.Time
+	ChunkSize  int       "chunkSize"
+	UploadDate time.Time "uploadDate"
 	Length     uint64
 	Filename   string ",omitempty"
 }